@@ -0,0 +1,215 @@
+package queue
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/pkg/errors"
+)
+
+// BlobStore keeps the bodies that are too large to travel inline in a message
+type BlobStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+}
+
+// iS3Session represents the interface to connect to a S3 bucket
+type iS3Session interface {
+	PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error)
+	GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error)
+	DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error)
+}
+
+type s3BlobStore struct {
+	S3     iS3Session
+	Bucket string
+}
+
+// NewS3BlobStore returns a BlobStore backed by the given S3 bucket
+func NewS3BlobStore(s3session iS3Session, bucket string) BlobStore {
+	return &s3BlobStore{
+		S3:     s3session,
+		Bucket: bucket,
+	}
+}
+
+func (s *s3BlobStore) Put(key string, data []byte) error {
+	params := s3.PutObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(data),
+	}
+
+	if _, err := s.S3.PutObject(&params); err != nil {
+		return errors.Wrap(err, "S3.PutObject error")
+	}
+
+	return nil
+}
+
+func (s *s3BlobStore) Get(key string) ([]byte, error) {
+	params := s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	}
+
+	response, err := s.S3.GetObject(&params)
+	if err != nil {
+		return nil, errors.Wrap(err, "S3.GetObject error")
+	}
+
+	defer response.Body.Close()
+
+	return ioutil.ReadAll(response.Body)
+}
+
+func (s *s3BlobStore) Delete(key string) error {
+	params := s3.DeleteObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	}
+
+	if _, err := s.S3.DeleteObject(&params); err != nil {
+		return errors.Wrap(err, "S3.DeleteObject error")
+	}
+
+	return nil
+}
+
+type fileBlobStore struct {
+	Dir string
+}
+
+// NewFileBlobStore returns a BlobStore that keeps the blobs as files in dir
+func NewFileBlobStore(dir string) BlobStore {
+	return &fileBlobStore{
+		Dir: dir,
+	}
+}
+
+func (s *fileBlobStore) path(key string) (string, error) {
+	if key == "" || filepath.Base(key) != key || strings.HasPrefix(key, ".") {
+		return "", ErrorBlobKeyInvalid
+	}
+
+	return filepath.Join(s.Dir, key), nil
+}
+
+func (s *fileBlobStore) Put(key string, data []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+func (s *fileBlobStore) Get(key string) ([]byte, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadFile(path)
+}
+
+func (s *fileBlobStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// offload moves the body to the blob store if the message doesn't fit into SQS.
+// The returned body is the one that should be sent to the queue
+func (q *queueSQS) offload(body string, messageAttributes map[string]*sqs.MessageAttributeValue) (string, error) {
+	threshold := q.OffloadThresholdBytes
+	if threshold == 0 {
+		threshold = maxMessageSizeBytes
+	}
+
+	if q.Blobs == nil || messageSize(body, messageAttributes) <= threshold {
+		return body, nil
+	}
+
+	key := newID()
+	if err := q.Blobs.Put(key, []byte(body)); err != nil {
+		return "", errors.Wrap(err, "offloading message body")
+	}
+
+	messageAttributes["BlobKey"] = &sqs.MessageAttributeValue{
+		DataType:    aws.String("String"),
+		StringValue: aws.String(key),
+	}
+
+	return key, nil
+}
+
+// rehydrate returns the body of the message, fetching it from the blob store if it was offloaded
+func (q *queueSQS) rehydrate(m *sqs.Message) (string, error) {
+	key := blobKey(m)
+	if key == "" {
+		return aws.StringValue(m.Body), nil
+	}
+
+	if q.Blobs == nil {
+		return "", ErrorBlobStoreNotSet
+	}
+
+	data, err := q.Blobs.Get(key)
+	if err != nil {
+		return "", errors.Wrap(err, "rehydrating message body")
+	}
+
+	return string(data), nil
+}
+
+// removeBlob deletes the offloaded body, if any, once the message is not needed anymore
+func (q *queueSQS) removeBlob(m *sqs.Message) error {
+	key := blobKey(m)
+	if key == "" || q.Blobs == nil {
+		return nil
+	}
+
+	return q.Blobs.Delete(key)
+}
+
+func blobKey(m *sqs.Message) string {
+	if keyAttr, ok := m.MessageAttributes["BlobKey"]; ok && keyAttr != nil {
+		return aws.StringValue(keyAttr.StringValue)
+	}
+
+	return ""
+}
+
+// messageSize computes the size of the message as SQS does, body plus attributes
+// as they are sent
+func messageSize(body string, messageAttributes map[string]*sqs.MessageAttributeValue) int {
+	if packed, err := packMeta(messageAttributes); err == nil {
+		messageAttributes = packed
+	}
+
+	size := len(body)
+	for name, attr := range messageAttributes {
+		size += len(name) + len(aws.StringValue(attr.DataType)) + len(aws.StringValue(attr.StringValue)) + len(attr.BinaryValue)
+	}
+
+	return size
+}
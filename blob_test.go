@@ -0,0 +1,194 @@
+package queue
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+)
+
+type Mock4BlobAWSSession struct {
+	objects map[string][]byte
+	deleted chan bool
+}
+
+func (a *Mock4BlobAWSSession) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	data, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	a.objects[aws.StringValue(input.Bucket)+"/"+aws.StringValue(input.Key)] = data
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (a *Mock4BlobAWSSession) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	data := a.objects[aws.StringValue(input.Bucket)+"/"+aws.StringValue(input.Key)]
+	return &s3.GetObjectOutput{
+		Body: ioutil.NopCloser(bytes.NewReader(data)),
+	}, nil
+}
+
+func (a *Mock4BlobAWSSession) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	delete(a.objects, aws.StringValue(input.Bucket)+"/"+aws.StringValue(input.Key))
+	if a.deleted != nil {
+		a.deleted <- true
+	}
+
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+/*
+	Case 1: the S3 store puts, gets and deletes objects in its bucket
+*/
+func Test_s3BlobStore_roundtrip(t *testing.T) {
+	session := &Mock4BlobAWSSession{objects: map[string][]byte{}}
+	store := NewS3BlobStore(session, "bucket")
+
+	assert.Nil(t, store.Put("key", []byte("a body")))
+	assert.Equal(t, []byte("a body"), session.objects["bucket/key"])
+
+	data, err := store.Get("key")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a body"), data)
+
+	assert.Nil(t, store.Delete("key"))
+	assert.Empty(t, session.objects)
+}
+
+/*
+	Case 2: the file store puts, gets and deletes files in its directory
+*/
+func Test_fileBlobStore_roundtrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobs")
+	assert.Nil(t, err)
+
+	store := NewFileBlobStore(dir)
+
+	assert.Nil(t, store.Put("key", []byte("a body")))
+
+	data, err := store.Get("key")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a body"), data)
+
+	assert.Nil(t, store.Delete("key"))
+	_, err = store.Get("key")
+	assert.NotNil(t, err)
+}
+
+/*
+	Case 3: the file store doesn't accept keys that escape its directory
+*/
+func Test_fileBlobStore_invalid_key(t *testing.T) {
+	store := NewFileBlobStore("/tmp")
+
+	_, err := store.Get("../etc/passwd")
+	assert.Equal(t, ErrorBlobKeyInvalid, err)
+	assert.Equal(t, ErrorBlobKeyInvalid, store.Put("", nil))
+}
+
+/*
+	Case 4: PutString offloads the body once the message exceeds the threshold
+*/
+func Test_PutString_offloads_large_body(t *testing.T) {
+	session := &MockAWSSessionThen{}
+	store := &Mock4BlobAWSSession{objects: map[string][]byte{}}
+	queue := NewSQSQueue(session, "", WithBlobStore(NewS3BlobStore(store, "bucket")), WithOffloadThreshold(150))
+
+	small := "a small body"
+	assert.Nil(t, queue.PutString("method", small, 0).Error)
+	assert.Equal(t, small, *session.input.MessageBody)
+	assert.NotContains(t, attributesOf(session.input), "BlobKey")
+
+	large := strings.Repeat("a large body ", 10)
+	assert.Nil(t, queue.PutString("method", large, 0).Error)
+
+	key := attributeOf(session.input, "BlobKey")
+	assert.Equal(t, key, *session.input.MessageBody)
+	assert.Equal(t, []byte(large), store.objects["bucket/"+key])
+}
+
+/*
+	Case 5: without a blob store the body is always sent inline
+*/
+func Test_PutString_without_blob_store(t *testing.T) {
+	session := &MockAWSSessionThen{}
+	queue := NewSQSQueue(session, "", WithOffloadThreshold(10))
+
+	large := strings.Repeat("a large body ", 10)
+	assert.Nil(t, queue.PutString("method", large, 0).Error)
+	assert.Equal(t, large, *session.input.MessageBody)
+}
+
+/*
+	Case 6: handleMessage rehydrates the body for the handler and removes the blob on success
+*/
+func Test_handleMessage_rehydrates_offloaded_body(t *testing.T) {
+	session := &Mock4handleMessageAWSSession{}
+	store := &Mock4BlobAWSSession{
+		objects: map[string][]byte{
+			"bucket/key": []byte(`{"msg":"a large message"}`),
+		},
+		deleted: make(chan bool),
+	}
+
+	queue := queueSQS{
+		queueConfig: queueConfig{
+			Blobs: NewS3BlobStore(store, "bucket"),
+		},
+		requests:  &requests{},
+		SQS:       session,
+		msgIDerrs: map[string]int{},
+	}
+
+	handler := func(msg interface{}) error {
+		assert.Equal(t, "a large message", msg)
+		return nil
+	}
+
+	msg := sqs.Message{}
+	msg.Body = aws.String("key")
+	msg.ReceiptHandle = aws.String("a receipt handle")
+	msg.MD5OfBody = aws.String("messageID")
+	msg.MessageAttributes = map[string]*sqs.MessageAttributeValue{
+		"BlobKey": {
+			DataType:    aws.String("String"),
+			StringValue: aws.String("key"),
+		},
+	}
+
+	assert.Nil(t, queue.handleMessage(handler, &msg))
+
+	<-store.deleted
+	assert.Empty(t, store.objects)
+	assert.Equal(t, 0, session.TimesCalledSendMessage)
+}
+
+/*
+	Case 7: a failed offloaded message is resent with its BlobKey and the blob is kept
+*/
+func Test_resendMessage_keeps_BlobKey(t *testing.T) {
+	session := &MockAWSSessionThen{}
+	queue := queueSQS{
+		requests: &requests{},
+		SQS:      session,
+	}
+
+	msg := sqs.Message{}
+	msg.Body = aws.String("key")
+	msg.MessageAttributes = map[string]*sqs.MessageAttributeValue{
+		"BlobKey": {
+			DataType:    aws.String("String"),
+			StringValue: aws.String("key"),
+		},
+	}
+
+	assert.Nil(t, queue.resendMessage(&msg))
+	assert.Equal(t, "key", *session.input.MessageBody)
+	assert.Equal(t, "key", attributeOf(session.input, "BlobKey"))
+}
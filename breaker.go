@@ -0,0 +1,207 @@
+package queue
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sqs"
+
+	// nolint: depguard
+	log "github.com/sirupsen/logrus"
+)
+
+// CircuitState is the state of the circuit breaker of a method
+type CircuitState int
+
+// These are the states of a circuit breaker
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+
+	return "closed"
+}
+
+// CircuitStats tells the state of the circuit breaker of a method and what it did
+type CircuitStats struct {
+	Method    string
+	State     CircuitState
+	Failures  int
+	Opened    int
+	Deferred  int
+	OpenUntil time.Time
+}
+
+type circuitBreaker struct {
+	threshold int
+	openFor   time.Duration
+	mutex     sync.Mutex
+	state     CircuitState
+	failures  int
+	opened    int
+	deferred  int
+	openUntil time.Time
+	probing   bool
+}
+
+// WithCircuitBreaker stops the dispatch to the method after threshold failures
+// in a row. While open, its messages are deferred without counting as retries.
+// After openFor, a single message probes the method: if it succeeds the circuit
+// closes, otherwise it opens again
+func WithCircuitBreaker(threshold int, openFor time.Duration) HandlerOption {
+	return func(config *handlerConfig) {
+		config.breaker = &circuitBreaker{
+			threshold: threshold,
+			openFor:   openFor,
+		}
+	}
+}
+
+// allow tells if a message may be handled now. If not, it returns how long the circuit stays open
+func (b *circuitBreaker) allow() (bool, time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == CircuitOpen {
+		if wait := time.Until(b.openUntil); wait > 0 {
+			b.deferred++
+			return false, wait
+		}
+
+		b.state = CircuitHalfOpen
+	}
+
+	if b.state == CircuitHalfOpen {
+		if b.probing {
+			b.deferred++
+			return false, b.openFor
+		}
+
+		b.probing = true
+	}
+
+	return true, 0
+}
+
+// record counts the result of a message allowed by allow, and tells if the circuit opened
+func (b *circuitBreaker) record(succeeded bool) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.probing = false
+
+	if succeeded {
+		b.state = CircuitClosed
+		b.failures = 0
+
+		return false
+	}
+
+	b.failures++
+
+	if b.state == CircuitHalfOpen || (b.state == CircuitClosed && b.failures >= b.threshold) {
+		b.state = CircuitOpen
+		b.openUntil = time.Now().Add(b.openFor)
+		b.opened++
+
+		return true
+	}
+
+	return false
+}
+
+// release ends the probe of a message allowed by allow that wasn't handled
+func (b *circuitBreaker) release() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.probing = false
+}
+
+func (b *circuitBreaker) stats(method string) CircuitStats {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return CircuitStats{
+		Method:    method,
+		State:     b.state,
+		Failures:  b.failures,
+		Opened:    b.opened,
+		Deferred:  b.deferred,
+		OpenUntil: b.openUntil,
+	}
+}
+
+// breakerOpen defers m if the circuit of its method is open, and tells if it did
+func (q *queueSQS) breakerOpen(m *sqs.Message) (bool, error) {
+	breaker := q.configFor(m).breaker
+	if breaker == nil {
+		return false, nil
+	}
+
+	allowed, wait := breaker.allow()
+	if allowed {
+		return false, nil
+	}
+
+	return true, q.requeue(m, waitSeconds(wait))
+}
+
+// breakerRecord counts the result of the handler of m
+func (q *queueSQS) breakerRecord(m *sqs.Message, err error) {
+	breaker := q.configFor(m).breaker
+	if breaker == nil {
+		return
+	}
+
+	if breaker.record(err == nil) {
+		stats := breaker.stats(methodOf(m))
+		log.Errorf("circuit of %s is open until %s", stats.Method, stats.OpenUntil.Format(time.RFC3339))
+	}
+}
+
+// breakerRelease ends the probe of m, if any, when its handler wasn't called
+func (q *queueSQS) breakerRelease(m *sqs.Message) {
+	if breaker := q.configFor(m).breaker; breaker != nil {
+		breaker.release()
+	}
+}
+
+// Circuit returns the stats of the circuit breaker of method, if it has one
+func (q *queueSQS) Circuit(method string) (CircuitStats, bool) {
+	config, ok := q.configNamed(method)
+	if !ok || config.breaker == nil {
+		return CircuitStats{}, false
+	}
+
+	return config.breaker.stats(method), true
+}
+
+// Circuits returns the stats of all the circuit breakers, sorted by method
+func (q *queueSQS) Circuits() []CircuitStats {
+	circuits := []CircuitStats{}
+
+	for _, configs := range []map[string]*handlerConfig{q.handlerConfigs, q.replyHandlerConfigs} {
+		for method := range configs {
+			if config, _ := q.configNamed(method); config == configs[method] && config.breaker != nil {
+				circuits = append(circuits, config.breaker.stats(method))
+			}
+		}
+	}
+
+	sort.Slice(circuits, func(i, j int) bool {
+		return circuits[i].Method < circuits[j].Method
+	})
+
+	return circuits
+}
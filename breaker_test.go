@@ -0,0 +1,141 @@
+package queue
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+	Case 1: the circuit opens after the threshold, half-opens to probe and closes once the probe succeeds
+*/
+func Test_circuitBreaker_states(t *testing.T) {
+	breaker := &circuitBreaker{threshold: 2, openFor: 50 * time.Millisecond}
+
+	allowed, _ := breaker.allow()
+	assert.True(t, allowed)
+	assert.False(t, breaker.record(false))
+
+	allowed, _ = breaker.allow()
+	assert.True(t, allowed)
+	assert.True(t, breaker.record(false))
+	assert.Equal(t, CircuitOpen, breaker.stats("method").State)
+
+	allowed, wait := breaker.allow()
+	assert.False(t, allowed)
+	assert.InDelta(t, 50*time.Millisecond, wait, float64(10*time.Millisecond))
+
+	time.Sleep(60 * time.Millisecond)
+
+	/*
+		Only one message probes the method
+	*/
+	allowed, _ = breaker.allow()
+	assert.True(t, allowed)
+	assert.Equal(t, CircuitHalfOpen, breaker.stats("method").State)
+
+	allowed, _ = breaker.allow()
+	assert.False(t, allowed)
+
+	breaker.record(true)
+
+	stats := breaker.stats("method")
+	assert.Equal(t, CircuitClosed, stats.State)
+	assert.Equal(t, 0, stats.Failures)
+	assert.Equal(t, 1, stats.Opened)
+	assert.Equal(t, 2, stats.Deferred)
+}
+
+/*
+	Case 2: a failed probe opens the circuit again
+*/
+func Test_circuitBreaker_probe_fails(t *testing.T) {
+	breaker := &circuitBreaker{threshold: 1, openFor: 10 * time.Millisecond}
+
+	breaker.allow()
+	breaker.record(false)
+
+	time.Sleep(20 * time.Millisecond)
+
+	allowed, _ := breaker.allow()
+	assert.True(t, allowed)
+	assert.True(t, breaker.record(false))
+	assert.Equal(t, CircuitOpen, breaker.stats("method").State)
+	assert.Equal(t, 2, breaker.stats("method").Opened)
+}
+
+/*
+	Case 3: while the circuit is open the messages are deferred without counting as retries
+*/
+func Test_handleMessage_circuit_open(t *testing.T) {
+	session := &Mock4EncryptAWSSession{sent: make(chan *sqs.SendMessageInput, 1)}
+	queue := NewSQSQueue(session, "requests").(*queueSQS)
+
+	calls := 0
+	handler := func(msg interface{}) error {
+		calls++
+		return errors.New("intentional error")
+	}
+
+	queue.Register("api.call", handler, WithCircuitBreaker(1, time.Minute))
+
+	assert.Nil(t, queue.PutJSON("api.call", "first", 0).Error)
+	assert.Nil(t, queue.handleMessage(handler, receivedMessage(<-session.sent)))
+
+	retried := <-session.sent
+	assert.Equal(t, "2", *retried.MessageAttributes["NextDelayRetry"].StringValue)
+
+	assert.Nil(t, queue.PutJSON("api.call", "second", 0).Error)
+	second := <-session.sent
+	assert.Nil(t, queue.handleMessage(handler, receivedMessage(second)))
+
+	deferred := <-session.sent
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, int64(60), *deferred.DelaySeconds)
+	assert.Equal(t, *second.MessageBody, *deferred.MessageBody)
+	assert.Equal(t, "1", *deferred.MessageAttributes["NextDelayRetry"].StringValue)
+
+	stats, ok := queue.Circuit("api.call")
+	assert.True(t, ok)
+	assert.Equal(t, CircuitOpen, stats.State)
+	assert.Equal(t, "open", stats.State.String())
+	assert.Equal(t, 1, stats.Deferred)
+	assert.Equal(t, []CircuitStats{stats}, queue.Circuits())
+
+	_, ok = queue.Circuit("unknown")
+	assert.False(t, ok)
+}
+
+/*
+	Case 4: a message that can't be decoded doesn't count as a failure of the method
+*/
+func Test_handleMessage_decode_error_is_neutral(t *testing.T) {
+	session := &Mock4EncryptAWSSession{sent: make(chan *sqs.SendMessageInput, 1)}
+	queue := NewSQSQueue(session, "requests").(*queueSQS)
+
+	handler := func(msg interface{}) error {
+		t.Error("the handler was called")
+		return nil
+	}
+
+	queue.Register("api.call", handler, WithCircuitBreaker(1, time.Minute))
+
+	assert.Nil(t, queue.PutString("api.call", "a message", 0).Error)
+	m := receivedMessage(<-session.sent)
+	m.MessageAttributes["ContentType"] = &sqs.MessageAttributeValue{
+		DataType:    aws.String("String"),
+		StringValue: aws.String("application/unknown"),
+	}
+
+	assert.Nil(t, queue.handleMessage(handler, m))
+	<-session.sent
+
+	stats, ok := queue.Circuit("api.call")
+	assert.True(t, ok)
+	assert.Equal(t, CircuitClosed, stats.State)
+	assert.Equal(t, 0, stats.Failures)
+}
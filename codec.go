@@ -0,0 +1,232 @@
+package queue
+
+import (
+	"encoding/json"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+// These are the content types of the built-in codecs
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeMsgpack  = "application/msgpack"
+	ContentTypeProtobuf = "application/protobuf"
+	ContentTypeRaw      = "application/octet-stream"
+)
+
+// Codec turns the messages into bytes and back. The ContentType travels in the
+// message, so the listener knows which codec decodes it
+type Codec interface {
+	ContentType() string
+	Marshal(msg interface{}) ([]byte, error)
+	Unmarshal(data []byte) (interface{}, error)
+}
+
+type jsonCodec struct{}
+
+// NewJSONCodec returns the codec used by PutJSON
+func NewJSONCodec() Codec {
+	return jsonCodec{}
+}
+
+func (jsonCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (jsonCodec) Marshal(msg interface{}) ([]byte, error) {
+	return json.Marshal(msgJSON{
+		Msg: msg,
+	})
+}
+
+func (jsonCodec) Unmarshal(data []byte) (interface{}, error) {
+	msg := msgJSON{}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+
+	return msg.Msg, nil
+}
+
+type msgpackCodec struct{}
+
+// NewMsgpackCodec returns a codec that encodes the messages with msgpack
+func NewMsgpackCodec() Codec {
+	return msgpackCodec{}
+}
+
+func (msgpackCodec) ContentType() string {
+	return ContentTypeMsgpack
+}
+
+func (msgpackCodec) Marshal(msg interface{}) ([]byte, error) {
+	return msgpack.Marshal(msg)
+}
+
+func (msgpackCodec) Unmarshal(data []byte) (interface{}, error) {
+	var msg interface{}
+	if err := msgpack.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+type protobufCodec struct {
+	prototype proto.Message
+}
+
+// NewProtobufCodec returns a codec for protobuf messages. The listener
+// gets new messages of the same type as prototype
+func NewProtobufCodec(prototype proto.Message) Codec {
+	return protobufCodec{
+		prototype: prototype,
+	}
+}
+
+func (protobufCodec) ContentType() string {
+	return ContentTypeProtobuf
+}
+
+func (protobufCodec) Marshal(msg interface{}) ([]byte, error) {
+	protoMsg, ok := msg.(proto.Message)
+	if !ok {
+		return nil, ErrorCodecUnsupportedType
+	}
+
+	return proto.Marshal(protoMsg)
+}
+
+func (c protobufCodec) Unmarshal(data []byte) (interface{}, error) {
+	msg := c.prototype.ProtoReflect().New().Interface()
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+type rawCodec struct{}
+
+// NewRawCodec returns a codec that sends []byte or string as they are.
+// The listener gets []byte
+func NewRawCodec() Codec {
+	return rawCodec{}
+}
+
+func (rawCodec) ContentType() string {
+	return ContentTypeRaw
+}
+
+func (rawCodec) Marshal(msg interface{}) ([]byte, error) {
+	switch value := msg.(type) {
+	case []byte:
+		return value, nil
+	case string:
+		return []byte(value), nil
+	default:
+		return nil, ErrorCodecUnsupportedType
+	}
+}
+
+func (rawCodec) Unmarshal(data []byte) (interface{}, error) {
+	return data, nil
+}
+
+// WithCodec sets the codec Put uses for the methods without their own codec
+func WithCodec(codec Codec) Option {
+	return func(q *queueSQS) {
+		q.Codec = codec
+	}
+}
+
+// WithMethodCodec sets the codec for method, on both Put and the listener
+func WithMethodCodec(method string, codec Codec) Option {
+	return func(q *queueSQS) {
+		if q.methodCodecs == nil {
+			q.methodCodecs = map[string]Codec{}
+		}
+
+		q.methodCodecs[method] = codec
+	}
+}
+
+// codecFor returns the codec Put uses for method
+func (q *queueSQS) codecFor(method string) Codec {
+	if codec, ok := q.methodCodecs[method]; ok {
+		return codec
+	}
+
+	if q.Codec != nil {
+		return q.Codec
+	}
+
+	return jsonCodec{}
+}
+
+// decoderFor returns the codec that understands the contentType of a message sent to method
+func (q *queueSQS) decoderFor(method, contentType string) (Codec, error) {
+	if codec, ok := q.methodCodecs[method]; ok && codec.ContentType() == contentType {
+		return codec, nil
+	}
+
+	if q.Codec != nil && q.Codec.ContentType() == contentType {
+		return q.Codec, nil
+	}
+
+	switch contentType {
+	case ContentTypeJSON:
+		return jsonCodec{}, nil
+	case ContentTypeMsgpack:
+		return msgpackCodec{}, nil
+	case ContentTypeRaw:
+		return rawCodec{}, nil
+	}
+
+	return nil, ErrorCodecNotFound
+}
+
+// marshal encodes msg with codec and records its content type
+func (q *queueSQS) marshal(codec Codec, msg interface{}, messageAttributes map[string]*sqs.MessageAttributeValue) ([]byte, error) {
+	data, err := codec.Marshal(msg)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s marshal error", codec.ContentType())
+	}
+
+	messageAttributes["ContentType"] = &sqs.MessageAttributeValue{
+		DataType:    aws.String("String"),
+		StringValue: aws.String(codec.ContentType()),
+	}
+
+	return data, nil
+}
+
+// decodeWith decodes data by the ContentType of the message. Old messages
+// without ContentType go through unmarshal
+func (q *queueSQS) decodeWith(data []byte, m *sqs.Message) (interface{}, error) {
+	contentTypeAttr, ok := m.MessageAttributes["ContentType"]
+	if !ok || contentTypeAttr == nil {
+		return q.unmarshal(string(data)), nil
+	}
+
+	method := ""
+	if methodAttr, ok := m.MessageAttributes["Method"]; ok && methodAttr != nil {
+		method = aws.StringValue(methodAttr.StringValue)
+	}
+
+	codec, err := q.decoderFor(method, aws.StringValue(contentTypeAttr.StringValue))
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := codec.Unmarshal(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s unmarshal error", codec.ContentType())
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,114 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+/*
+	Case 1: PutJSON records the JSON content type and the listener decodes it
+*/
+func Test_codec_json_roundtrip(t *testing.T) {
+	session := &MockAWSSessionThen{}
+	queue := NewSQSQueue(session, "").(*queueSQS)
+
+	expected := map[string]interface{}{"key": "value"}
+	assert.Nil(t, queue.PutJSON("method", expected, 0).Error)
+	assert.Equal(t, ContentTypeJSON, attributeOf(session.input, "ContentType"))
+
+	actual, err := queue.decode(receivedMessage(session.input))
+	assert.Nil(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+/*
+	Case 2: Put uses the codec of the queue, msgpack here
+*/
+func Test_codec_msgpack_roundtrip(t *testing.T) {
+	session := &MockAWSSessionThen{}
+	queue := NewSQSQueue(session, "", WithCodec(NewMsgpackCodec())).(*queueSQS)
+
+	expected := map[string]interface{}{"key": "value"}
+	assert.Nil(t, queue.Put("method", expected, 0).Error)
+	assert.Equal(t, ContentTypeMsgpack, attributeOf(session.input, "ContentType"))
+
+	actual, err := queue.decode(receivedMessage(session.input))
+	assert.Nil(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+/*
+	Case 3: Put uses the codec of the method, protobuf here, and the listener gets the same type
+*/
+func Test_codec_protobuf_per_method(t *testing.T) {
+	session := &MockAWSSessionThen{}
+	queue := NewSQSQueue(session, "", WithMethodCodec("proto_method", NewProtobufCodec(&wrapperspb.StringValue{}))).(*queueSQS)
+
+	expected := wrapperspb.String("a protobuf message")
+	assert.Nil(t, queue.Put("proto_method", expected, 0).Error)
+	assert.Equal(t, ContentTypeProtobuf, attributeOf(session.input, "ContentType"))
+
+	actual, err := queue.decode(receivedMessage(session.input))
+	assert.Nil(t, err)
+	assert.True(t, proto.Equal(expected, actual.(proto.Message)))
+
+	assert.Nil(t, queue.Put("another_method", "json", 0).Error)
+	assert.Equal(t, ContentTypeJSON, attributeOf(session.input, "ContentType"))
+}
+
+/*
+	Case 4: raw bytes travel base64 encoded and the listener gets them back
+*/
+func Test_codec_raw_bytes_roundtrip(t *testing.T) {
+	session := &MockAWSSessionThen{}
+	queue := NewSQSQueue(session, "", WithCodec(NewRawCodec())).(*queueSQS)
+
+	expected := []byte{0, 1, 2, 0xff}
+	assert.Nil(t, queue.Put("method", expected, 0).Error)
+	assert.Equal(t, "base64", attributeOf(session.input, "BodyEncoding"))
+
+	actual, err := queue.decode(receivedMessage(session.input))
+	assert.Nil(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+/*
+	Case 5: a codec that can't encode the message makes Put fail
+*/
+func Test_codec_unsupported_type(t *testing.T) {
+	queue := NewSQSQueue(&MockAWSSessionThen{}, "", WithCodec(NewRawCodec()))
+
+	err := queue.Put("method", 10, 0).Error
+	assert.NotNil(t, err)
+	assert.Equal(t, "application/octet-stream marshal error: "+ErrorCodecUnsupportedType.Error(), err.Error())
+}
+
+/*
+	Case 6: a body that doesn't match its content type is an error, not a raw string
+*/
+func Test_codec_decode_errors(t *testing.T) {
+	queue := NewSQSQueue(&MockAWSSessionThen{}, "").(*queueSQS)
+
+	msg := &sqs.Message{
+		Body: aws.String("not a JSON"),
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			"ContentType": {
+				DataType:    aws.String("String"),
+				StringValue: aws.String(ContentTypeJSON),
+			},
+		},
+	}
+
+	_, err := queue.decode(msg)
+	assert.NotNil(t, err)
+
+	msg.MessageAttributes["ContentType"].StringValue = aws.String(ContentTypeProtobuf)
+
+	_, err = queue.decode(msg)
+	assert.Equal(t, ErrorCodecNotFound, err)
+}
@@ -0,0 +1,100 @@
+package queue
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// These are the supported values for WithCompression
+const (
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+)
+
+// WithCompression compresses the body of every message put into the queue
+// by using encoding, that is EncodingGzip or EncodingZstd
+func WithCompression(encoding string) Option {
+	return func(q *queueSQS) {
+		q.Compression = encoding
+	}
+}
+
+// compress applies the configured compression and marks it in the ContentEncoding attribute
+func (q *queueSQS) compress(data []byte, messageAttributes map[string]*sqs.MessageAttributeValue) ([]byte, error) {
+	if q.Compression == "" {
+		return data, nil
+	}
+
+	buffer := bytes.Buffer{}
+
+	switch q.Compression {
+	case EncodingGzip:
+		writer := gzip.NewWriter(&buffer)
+		if _, err := writer.Write(data); err != nil {
+			return nil, errors.Wrap(err, "gzip compression")
+		}
+
+		if err := writer.Close(); err != nil {
+			return nil, errors.Wrap(err, "gzip compression")
+		}
+	case EncodingZstd:
+		writer, err := zstd.NewWriter(&buffer)
+		if err != nil {
+			return nil, errors.Wrap(err, "zstd compression")
+		}
+
+		if _, err := writer.Write(data); err != nil {
+			return nil, errors.Wrap(err, "zstd compression")
+		}
+
+		if err := writer.Close(); err != nil {
+			return nil, errors.Wrap(err, "zstd compression")
+		}
+	default:
+		return nil, ErrorEncodingUnknown
+	}
+
+	messageAttributes["ContentEncoding"] = &sqs.MessageAttributeValue{
+		DataType:    aws.String("String"),
+		StringValue: aws.String(q.Compression),
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// decompress reverts compress. Messages without ContentEncoding are returned as they came
+func (q *queueSQS) decompress(data []byte, m *sqs.Message) ([]byte, error) {
+	encodingAttr, ok := m.MessageAttributes["ContentEncoding"]
+	if !ok || encodingAttr == nil {
+		return data, nil
+	}
+
+	switch aws.StringValue(encodingAttr.StringValue) {
+	case EncodingGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, errors.Wrap(err, "gzip decompression")
+		}
+
+		defer reader.Close()
+
+		return ioutil.ReadAll(reader)
+	case EncodingZstd:
+		reader, err := zstd.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, errors.Wrap(err, "zstd decompression")
+		}
+
+		defer reader.Close()
+
+		return ioutil.ReadAll(reader)
+	default:
+		return nil, ErrorEncodingUnknown
+	}
+}
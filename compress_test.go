@@ -0,0 +1,98 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+)
+
+// receivedMessage builds the message the listener would get for the last sent input
+func receivedMessage(input *sqs.SendMessageInput) *sqs.Message {
+	messageAttributes := map[string]*sqs.MessageAttributeValue{}
+	for name, attr := range input.MessageAttributes {
+		messageAttributes[name] = attr
+	}
+
+	m := &sqs.Message{
+		Body:              input.MessageBody,
+		MessageAttributes: messageAttributes,
+		MessageId:         aws.String("messageID"),
+		MD5OfBody:         aws.String("messageID"),
+	}
+	unpackMeta(m)
+
+	return m
+}
+
+/*
+	Case 1: PutJSON compresses with gzip and the listener gets the original message
+*/
+func Test_compression_gzip_roundtrip(t *testing.T) {
+	session := &MockAWSSessionThen{}
+	queue := NewSQSQueue(session, "", WithCompression(EncodingGzip)).(*queueSQS)
+
+	expected := map[string]interface{}{"key": "a verbose value, a verbose value, a verbose value"}
+	assert.Nil(t, queue.PutJSON("method", expected, 0).Error)
+	assert.Equal(t, EncodingGzip, attributeOf(session.input, "ContentEncoding"))
+	assert.Equal(t, "base64", attributeOf(session.input, "BodyEncoding"))
+
+	actual, err := queue.decode(receivedMessage(session.input))
+	assert.Nil(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+/*
+	Case 2: PutString compresses with zstd and the listener gets the original message
+*/
+func Test_compression_zstd_roundtrip(t *testing.T) {
+	session := &MockAWSSessionThen{}
+	queue := NewSQSQueue(session, "", WithCompression(EncodingZstd)).(*queueSQS)
+
+	expected := "a verbose string, a verbose string, a verbose string"
+	assert.Nil(t, queue.PutString("method", expected, 0).Error)
+	assert.Equal(t, EncodingZstd, attributeOf(session.input, "ContentEncoding"))
+
+	actual, err := queue.decode(receivedMessage(session.input))
+	assert.Nil(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+/*
+	Case 3: messages without ContentEncoding are taken raw, as the old ones were
+*/
+func Test_compression_raw_fallback(t *testing.T) {
+	queue := NewSQSQueue(&MockAWSSessionThen{}, "", WithCompression(EncodingGzip)).(*queueSQS)
+
+	msg := &sqs.Message{
+		Body: aws.String(`{"msg":"an old message"}`),
+	}
+
+	actual, err := queue.decode(msg)
+	assert.Nil(t, err)
+	assert.Equal(t, "an old message", actual)
+}
+
+/*
+	Case 4: unknown encodings fail on both sides
+*/
+func Test_compression_unknown_encoding(t *testing.T) {
+	session := &MockAWSSessionThen{}
+	queue := NewSQSQueue(session, "", WithCompression("brotli")).(*queueSQS)
+
+	assert.Equal(t, ErrorEncodingUnknown, queue.PutString("method", "a message", 0).Error)
+
+	msg := &sqs.Message{
+		Body: aws.String("a message"),
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			"ContentEncoding": {
+				DataType:    aws.String("String"),
+				StringValue: aws.String("brotli"),
+			},
+		},
+	}
+
+	_, err := queue.decode(msg)
+	assert.Equal(t, ErrorEncodingUnknown, err)
+}
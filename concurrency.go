@@ -0,0 +1,83 @@
+package queue
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/pkg/errors"
+)
+
+// concurrencyDelaySeconds is how long a message for a saturated method waits
+const concurrencyDelaySeconds = 1
+
+// iSQSVisibility is the part of the SQS client that defers a message received
+type iSQSVisibility interface {
+	ChangeMessageVisibility(input *sqs.ChangeMessageVisibilityInput) (*sqs.ChangeMessageVisibilityOutput, error)
+}
+
+// WithMaxConcurrency limits how many messages of the method are handled at
+// once. The messages that arrive while the method is saturated are deferred,
+// without counting as retries, so the other methods keep going. An n below 1
+// sets no limit
+func WithMaxConcurrency(n int) HandlerOption {
+	return func(config *handlerConfig) {
+		if n < 1 {
+			config.inFlight = nil
+			return
+		}
+
+		config.inFlight = make(chan struct{}, n)
+	}
+}
+
+// acquire takes a slot of the method of m, and tells if there was one
+func (q *queueSQS) acquire(m *sqs.Message) bool {
+	inFlight := q.configFor(m).inFlight
+	if inFlight == nil {
+		return true
+	}
+
+	select {
+	case inFlight <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// deferSaturated leaves m in the queue, hidden for a while. A client without
+// ChangeMessageVisibility deletes m and sends a copy with a delay instead
+func (q *queueSQS) deferSaturated(m *sqs.Message, params *sqs.DeleteMessageInput) error {
+	if visibility, ok := q.SQS.(iSQSVisibility); ok {
+		_, err := visibility.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+			QueueUrl:          params.QueueUrl,
+			ReceiptHandle:     m.ReceiptHandle,
+			VisibilityTimeout: aws.Int64(concurrencyDelaySeconds),
+		})
+
+		return errors.Wrap(err, "deferring message")
+	}
+
+	if _, err := q.SQS.DeleteMessage(params); err != nil {
+		return err
+	}
+
+	return q.requeue(m, concurrencyDelaySeconds)
+}
+
+// release gives back the slot taken by acquire
+func (q *queueSQS) release(m *sqs.Message) {
+	if inFlight := q.configFor(m).inFlight; inFlight != nil {
+		<-inFlight
+	}
+}
+
+// InFlight returns how many messages of method are being handled, for the
+// methods registered with WithMaxConcurrency
+func (q *queueSQS) InFlight(method string) (int, bool) {
+	config, ok := q.configNamed(method)
+	if !ok || config.inFlight == nil {
+		return 0, false
+	}
+
+	return len(config.inFlight), true
+}
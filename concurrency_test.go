@@ -0,0 +1,140 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+	Case 1: a message for a saturated method is deferred, the other methods keep going
+*/
+func Test_handleMessage_max_concurrency(t *testing.T) {
+	session := &Mock4EncryptAWSSession{sent: make(chan *sqs.SendMessageInput, 1)}
+	queue := NewSQSQueue(session, "requests").(*queueSQS)
+
+	started := make(chan interface{}, 3)
+	unblock := make(chan bool)
+
+	slow := func(msg interface{}) error {
+		started <- msg
+		<-unblock
+
+		return nil
+	}
+	fast := func(msg interface{}) error {
+		started <- msg
+		return nil
+	}
+
+	queue.Register("slow", slow, WithMaxConcurrency(1))
+	queue.Register("fast", fast)
+
+	assert.Nil(t, queue.PutJSON("slow", "first", 0).Error)
+	assert.Nil(t, queue.handleMessage(slow, receivedMessage(<-session.sent)))
+	assert.Equal(t, "first", <-started)
+
+	inFlight, ok := queue.InFlight("slow")
+	assert.True(t, ok)
+	assert.Equal(t, 1, inFlight)
+
+	assert.Nil(t, queue.PutJSON("slow", "second", 0).Error)
+	second := <-session.sent
+	second.MessageAttributes["NextDelayRetry"] = queue.nextDelayRetry(2)
+	assert.Nil(t, queue.handleMessage(slow, receivedMessage(second)))
+
+	deferred := <-session.sent
+	assert.Equal(t, int64(concurrencyDelaySeconds), *deferred.DelaySeconds)
+	assert.Equal(t, *second.MessageBody, *deferred.MessageBody)
+	assert.Equal(t, "3", *deferred.MessageAttributes["NextDelayRetry"].StringValue)
+
+	assert.Nil(t, queue.PutJSON("fast", "third", 0).Error)
+	assert.Nil(t, queue.handleMessage(fast, receivedMessage(<-session.sent)))
+	assert.Equal(t, "third", <-started)
+
+	/*
+		Once the slot is free the deferred message is handled
+	*/
+	unblock <- true
+
+	for i := 0; i < 100; i++ {
+		if inFlight, _ = queue.InFlight("slow"); inFlight == 0 {
+			break
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	assert.Nil(t, queue.handleMessage(slow, receivedMessage(deferred)))
+	assert.Equal(t, "second", <-started)
+
+	unblock <- true
+
+	_, ok = queue.InFlight("fast")
+	assert.False(t, ok)
+}
+
+type Mock4VisibilityAWSSession struct {
+	Mock4EncryptAWSSession
+	visibility chan *sqs.ChangeMessageVisibilityInput
+}
+
+func (a *Mock4VisibilityAWSSession) ChangeMessageVisibility(input *sqs.ChangeMessageVisibilityInput) (*sqs.ChangeMessageVisibilityOutput, error) {
+	a.visibility <- input
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+/*
+	Case 2: if the client can change the visibility, a saturated message stays in the queue hidden for a while
+*/
+func Test_handleMessage_max_concurrency_visibility(t *testing.T) {
+	session := &Mock4VisibilityAWSSession{
+		Mock4EncryptAWSSession: Mock4EncryptAWSSession{sent: make(chan *sqs.SendMessageInput, 1)},
+		visibility:             make(chan *sqs.ChangeMessageVisibilityInput, 1),
+	}
+	queue := NewSQSQueue(session, "requests").(*queueSQS)
+
+	started := make(chan interface{}, 1)
+	unblock := make(chan bool)
+
+	slow := func(msg interface{}) error {
+		started <- msg
+		<-unblock
+
+		return nil
+	}
+
+	queue.Register("slow", slow, WithMaxConcurrency(1))
+
+	assert.Nil(t, queue.PutJSON("slow", "first", 0).Error)
+	assert.Nil(t, queue.handleMessage(slow, receivedMessage(<-session.sent)))
+	assert.Equal(t, "first", <-started)
+
+	assert.Nil(t, queue.PutJSON("slow", "second", 0).Error)
+	second := receivedMessage(<-session.sent)
+	second.ReceiptHandle = aws.String("second")
+	assert.Nil(t, queue.handleMessage(slow, second))
+
+	deferred := <-session.visibility
+	assert.Equal(t, "second", *deferred.ReceiptHandle)
+	assert.Equal(t, int64(concurrencyDelaySeconds), *deferred.VisibilityTimeout)
+	assert.Empty(t, session.sent)
+
+	unblock <- true
+}
+
+/*
+	Case 3: a non-positive limit is ignored, the method isn't limited
+*/
+func Test_WithMaxConcurrency_non_positive(t *testing.T) {
+	queue := NewSQSQueue(&Mock4EncryptAWSSession{}, "requests").(*queueSQS)
+
+	queue.Register("method", func(msg interface{}) error { return nil }, WithMaxConcurrency(0))
+
+	_, ok := queue.InFlight("method")
+	assert.False(t, ok)
+	assert.True(t, queue.acquire(messageFor("method")))
+}
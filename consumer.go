@@ -0,0 +1,228 @@
+package queue
+
+import (
+	"sync"
+	"time"
+
+	// nolint: depguard
+	log "github.com/sirupsen/logrus"
+)
+
+const consumerIdleMillisecondsDefault = 500
+
+// Lane is a queue polled by a Consumer. The higher the weight, the more often it's polled
+type Lane struct {
+	URL    string
+	Weight int
+}
+
+type lane struct {
+	queue   *queueSQS
+	weight  int
+	current int
+}
+
+// Consumer polls several queues with the handlers and the configuration of one
+// queue, e.g. an urgent queue and a bulk one
+type Consumer struct {
+	lanes    []*lane
+	strict   bool
+	idle     time.Duration
+	workers  chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// ConsumerOption configures the consumer returned by NewConsumer
+type ConsumerOption func(c *Consumer)
+
+// WithStrictPriority polls the lanes in their order: a lane is only polled
+// once the ones before it are empty
+func WithStrictPriority() ConsumerOption {
+	return func(c *Consumer) {
+		c.strict = true
+	}
+}
+
+// WithWorkers handles at most n messages at once, from all the lanes together.
+// An n below 1 sets no limit
+func WithWorkers(n int) ConsumerOption {
+	return func(c *Consumer) {
+		if n < 1 {
+			c.workers = nil
+			return
+		}
+
+		c.workers = make(chan struct{}, n)
+	}
+}
+
+// WithIdleWait sets how long the consumer waits once all the lanes were empty
+func WithIdleWait(wait time.Duration) ConsumerOption {
+	return func(c *Consumer) {
+		c.idle = wait
+	}
+}
+
+// NewConsumer returns a consumer of lanes. The handlers registered in queue,
+// before or after this call, handle the messages of all the lanes. queue must
+// be one returned by NewSQSQueue
+func NewConsumer(queue SQSQueue, lanes []Lane, opts ...ConsumerOption) (*Consumer, error) {
+	q, ok := queue.(*queueSQS)
+	if !ok {
+		return nil, ErrorQueueNotSupported
+	}
+
+	c := &Consumer{
+		idle: consumerIdleMillisecondsDefault * time.Millisecond,
+		stop: make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	for _, l := range lanes {
+		laneQueue := q.forURL(l.URL)
+		laneQueue.workers = c.workers
+
+		weight := l.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+
+		c.lanes = append(c.lanes, &lane{
+			queue:  laneQueue,
+			weight: weight,
+		})
+	}
+
+	return c, nil
+}
+
+// forURL returns a queue for url that shares the registry, the configuration
+// and the requests of q
+func (q *queueSQS) forURL(url string) *queueSQS {
+	if q.replyHandlerMap == nil {
+		q.replyHandlerMap = map[string]ReplyHandler{}
+	}
+
+	if q.handlerConfigs == nil {
+		q.handlerConfigs = map[string]*handlerConfig{}
+	}
+
+	if q.replyHandlerConfigs == nil {
+		q.replyHandlerConfigs = map[string]*handlerConfig{}
+	}
+
+	if q.sagaMap == nil {
+		q.sagaMap = map[string][]SagaStep{}
+	}
+
+	if q.handlers == nil {
+		q.handlers = &methodMatcher{}
+	}
+
+	if q.requests == nil {
+		q.requests = &requests{}
+	}
+
+	return &queueSQS{
+		queueConfig: q.queueConfig,
+		requests:    q.requests,
+		SQS:         q.SQS,
+		URL:         url,
+		msgIDerrs:   map[string]int{},
+	}
+}
+
+// Listen polls the lanes until Stop
+func (c *Consumer) Listen() {
+	log.Info("Starting the consumer process")
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		default:
+		}
+
+		if c.poll() > 0 {
+			continue
+		}
+
+		timer := time.NewTimer(c.idle)
+
+		select {
+		case <-c.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Stop ends Listen once the messages it got are dispatched, it may be called
+// more than once
+func (c *Consumer) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+}
+
+// poll handles the messages of the first lane, in the order of this round,
+// that has any. It returns how many messages it got
+func (c *Consumer) poll() int {
+	for _, l := range c.order() {
+		messages, err := l.queue.receive(0)
+		if err != nil {
+			log.Errorf("polling %s: %v", l.queue.URL, err)
+			continue
+		}
+
+		if len(messages) == 0 {
+			continue
+		}
+
+		for _, msg := range messages {
+			if err := l.queue.dispatch(msg); err != nil {
+				log.Errorf("polling %s: %v", l.queue.URL, err)
+			}
+		}
+
+		return len(messages)
+	}
+
+	return 0
+}
+
+// order returns the lanes in the order to poll them this round. With weights,
+// the first one is picked by smooth weighted round-robin
+func (c *Consumer) order() []*lane {
+	if c.strict || len(c.lanes) < 2 {
+		return c.lanes
+	}
+
+	total := 0
+	picked := 0
+
+	for i, l := range c.lanes {
+		total += l.weight
+		l.current += l.weight
+
+		if l.current > c.lanes[picked].current {
+			picked = i
+		}
+	}
+
+	c.lanes[picked].current -= total
+
+	order := []*lane{c.lanes[picked]}
+	for i, l := range c.lanes {
+		if i != picked {
+			order = append(order, l)
+		}
+	}
+
+	return order
+}
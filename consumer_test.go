@@ -0,0 +1,192 @@
+package queue
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func laneURLs(lanes []*lane) []string {
+	urls := []string{}
+	for _, l := range lanes {
+		urls = append(urls, l.queue.URL)
+	}
+
+	return urls
+}
+
+/*
+	Case 1: with strict priority the urgent lane is drained first
+*/
+func Test_Consumer_strict_priority(t *testing.T) {
+	session := &Mock4ReplyAWSSession{}
+	queue := NewSQSQueue(session, "urgent")
+	bulk := NewSQSQueue(session, "bulk")
+
+	handled := make(chan interface{}, 4)
+	consumer, err := NewConsumer(queue, []Lane{{URL: "urgent"}, {URL: "bulk"}}, WithStrictPriority())
+	assert.Nil(t, err)
+
+	/*
+		The handlers may be registered after the consumer is created
+	*/
+	queue.Register("call", func(msg interface{}) error {
+		handled <- msg
+		return nil
+	})
+
+	assert.Nil(t, bulk.PutJSON("call", "bulk 1", 0).Error)
+	assert.Nil(t, bulk.PutJSON("call", "bulk 2", 0).Error)
+	assert.Nil(t, queue.PutJSON("call", "urgent 1", 0).Error)
+	assert.Nil(t, queue.PutJSON("call", "urgent 2", 0).Error)
+
+	assert.Equal(t, 2, consumer.poll())
+	assert.ElementsMatch(t, []interface{}{"urgent 1", "urgent 2"}, []interface{}{<-handled, <-handled})
+
+	assert.Equal(t, 2, consumer.poll())
+	assert.ElementsMatch(t, []interface{}{"bulk 1", "bulk 2"}, []interface{}{<-handled, <-handled})
+
+	assert.Equal(t, 0, consumer.poll())
+}
+
+/*
+	Case 2: with weights each lane leads the rounds in proportion to its weight
+*/
+func Test_Consumer_weights(t *testing.T) {
+	queue := NewSQSQueue(&Mock4ReplyAWSSession{}, "urgent")
+	consumer, err := NewConsumer(queue, []Lane{{URL: "urgent", Weight: 2}, {URL: "bulk", Weight: 1}})
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{"urgent", "bulk"}, laneURLs(consumer.order()))
+	assert.Equal(t, []string{"bulk", "urgent"}, laneURLs(consumer.order()))
+	assert.Equal(t, []string{"urgent", "bulk"}, laneURLs(consumer.order()))
+	assert.Equal(t, []string{"urgent", "bulk"}, laneURLs(consumer.order()))
+	assert.Equal(t, []string{"bulk", "urgent"}, laneURLs(consumer.order()))
+	assert.Equal(t, []string{"urgent", "bulk"}, laneURLs(consumer.order()))
+}
+
+/*
+	Case 3: the worker pool is shared by the lanes
+*/
+func Test_Consumer_workers(t *testing.T) {
+	session := &Mock4ReplyAWSSession{}
+	queue := NewSQSQueue(session, "urgent")
+	bulk := NewSQSQueue(session, "bulk")
+
+	started := make(chan interface{}, 2)
+	unblock := make(chan bool)
+
+	queue.Register("call", func(msg interface{}) error {
+		started <- msg
+		<-unblock
+
+		return nil
+	})
+
+	consumer, err := NewConsumer(queue, []Lane{{URL: "urgent"}, {URL: "bulk"}}, WithStrictPriority(), WithWorkers(1))
+	assert.Nil(t, err)
+
+	assert.Nil(t, queue.PutJSON("call", "urgent", 0).Error)
+	assert.Nil(t, bulk.PutJSON("call", "bulk", 0).Error)
+
+	assert.Equal(t, 1, consumer.poll())
+	assert.Equal(t, "urgent", <-started)
+
+	polled := make(chan int)
+	go func() {
+		polled <- consumer.poll()
+	}()
+
+	select {
+	case msg := <-started:
+		t.Errorf("%v started without a free worker", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unblock <- true
+	assert.Equal(t, "bulk", <-started)
+	assert.Equal(t, 1, <-polled)
+
+	unblock <- true
+}
+
+/*
+	Case 4: the requests put by the queue are settled by the lanes
+*/
+func Test_Consumer_settles_requests(t *testing.T) {
+	session := &Mock4ReplyAWSSession{}
+	queue := NewSQSQueue(session, "urgent")
+
+	queue.Register("call", func(msg interface{}) error {
+		return Permanent(errors.New("intentional error"))
+	})
+
+	consumer, err := NewConsumer(queue, []Lane{{URL: "urgent"}})
+	assert.Nil(t, err)
+
+	caught := make(chan error, 1)
+	finished := make(chan bool, 1)
+	queue.PutJSON("call", "a message", 0).Catch(func(err error, msg interface{}) {
+		caught <- err
+	}).Finally(func() {
+		finished <- true
+	})
+
+	assert.Equal(t, 1, consumer.poll())
+	assert.EqualError(t, <-caught, "intentional error")
+	assert.True(t, <-finished)
+}
+
+/*
+	Case 5: Stop ends Listen, even while it waits for messages
+*/
+func Test_Consumer_Stop(t *testing.T) {
+	queue := NewSQSQueue(&Mock4ReplyAWSSession{}, "urgent")
+	consumer, err := NewConsumer(queue, []Lane{{URL: "urgent"}}, WithIdleWait(time.Hour))
+	assert.Nil(t, err)
+
+	stopped := make(chan bool)
+	go func() {
+		consumer.Listen()
+		stopped <- true
+	}()
+
+	consumer.Stop()
+	consumer.Stop()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("Listen didn't stop")
+	}
+}
+
+/*
+	Case 6: only the queues of NewSQSQueue may be consumed, a non-positive number of workers is ignored
+*/
+func Test_NewConsumer_options(t *testing.T) {
+	_, err := NewConsumer(struct{ SQSQueue }{}, []Lane{{URL: "urgent"}})
+	assert.Equal(t, ErrorQueueNotSupported, err)
+
+	queue := NewSQSQueue(&Mock4ReplyAWSSession{}, "urgent")
+
+	handled := make(chan interface{}, 1)
+	queue.Register("call", func(msg interface{}) error {
+		handled <- msg
+		return nil
+	})
+
+	consumer, err := NewConsumer(queue, []Lane{{URL: "urgent"}}, WithWorkers(0))
+	assert.Nil(t, err)
+	assert.Nil(t, consumer.workers)
+
+	assert.Nil(t, queue.PutJSON("call", "a message", 0).Error)
+	assert.Equal(t, 1, consumer.poll())
+	assert.Equal(t, "a message", <-handled)
+
+	consumer, err = NewConsumer(queue, []Lane{{URL: "urgent"}}, WithWorkers(-1))
+	assert.Nil(t, err)
+	assert.Nil(t, consumer.workers)
+}
@@ -0,0 +1,199 @@
+package queue
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
+
+	// nolint: depguard
+	log "github.com/sirupsen/logrus"
+)
+
+// CronEntry describes a job of the scheduler
+type CronEntry struct {
+	Name   string
+	Spec   string
+	Method string
+	Prev   time.Time
+	Next   time.Time
+}
+
+type cronJob struct {
+	CronEntry
+	schedule cron.Schedule
+	msg      interface{}
+}
+
+// Scheduler puts a message for a registered method at each tick of a cron
+// expression. Every instance may run it: the messages of a tick carry the same
+// IdempotencyKey, so the listener handles only one of them. That requires a
+// dedup store shared by the listeners, see WithDedupStore, otherwise each
+// instance that runs the scheduler sends a message per tick. On a FIFO queue
+// the messages of a tick carry the same MessageDeduplicationId too, see
+// DeduplicationID for the limits of the FIFO queues
+type Scheduler struct {
+	queue    SQSQueue
+	mutex    sync.Mutex
+	jobs     map[string]*cronJob
+	wake     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	now      func() time.Time
+}
+
+// NewScheduler returns a scheduler that sends to queue
+func NewScheduler(queue SQSQueue) *Scheduler {
+	return &Scheduler{
+		queue: queue,
+		jobs:  map[string]*cronJob{},
+		wake:  make(chan struct{}, 1),
+		stop:  make(chan struct{}),
+		now:   time.Now,
+	}
+}
+
+// AddJob sends msg to method at each tick of spec. The spec has the five
+// standard fields, or a descriptor like @hourly or @every 10m. The name
+// identifies the job across instances, so it must be the same in all of them
+func (s *Scheduler) AddJob(name, spec, method string, msg interface{}) error {
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return errors.Wrapf(err, "parsing %s", spec)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.jobs[name]; ok {
+		return ErrorCronJobExists
+	}
+
+	s.jobs[name] = &cronJob{
+		CronEntry: CronEntry{
+			Name:   name,
+			Spec:   spec,
+			Method: method,
+			Next:   schedule.Next(s.now()),
+		},
+		schedule: schedule,
+		msg:      msg,
+	}
+
+	/*
+		The new job may be due before the one Run waits for
+	*/
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// RemoveJob stops the job name
+func (s *Scheduler) RemoveJob(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.jobs, name)
+}
+
+// Entries returns the jobs sorted by their next run
+func (s *Scheduler) Entries() []CronEntry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entries := make([]CronEntry, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		entries = append(entries, job.CronEntry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Next.Before(entries[j].Next)
+	})
+
+	return entries
+}
+
+// Next returns the next run of the job name
+func (s *Scheduler) Next(name string) (time.Time, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	job, ok := s.jobs[name]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return job.Next, true
+}
+
+// Run sends the messages of the jobs at their ticks until Stop
+func (s *Scheduler) Run() {
+	for {
+		wait := time.Minute
+		if entries := s.Entries(); len(entries) > 0 {
+			wait = entries[0].Next.Sub(s.now())
+		}
+
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-s.stop:
+			timer.Stop()
+			return
+		case <-s.wake:
+			timer.Stop()
+		case <-timer.C:
+			s.tick(s.now())
+		}
+	}
+}
+
+// Stop ends Run, it may be called more than once
+func (s *Scheduler) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+}
+
+// tick sends the messages of the jobs due at now. A job that missed several
+// ticks runs once, for the last of them
+func (s *Scheduler) tick(now time.Time) {
+	s.mutex.Lock()
+	due := []cronJob{}
+
+	for _, job := range s.jobs {
+		if job.Next.After(now) {
+			continue
+		}
+
+		at := job.Next
+		for next := job.schedule.Next(at); !next.After(now); next = job.schedule.Next(next) {
+			at = next
+		}
+
+		job.Prev = at
+		job.Next = job.schedule.Next(now)
+		due = append(due, *job)
+	}
+	s.mutex.Unlock()
+
+	for _, job := range due {
+		key := tickKey(job.Name, job.Prev)
+		thenable := s.queue.Put(job.Method, job.msg, 0, IdempotencyKey(key), DeduplicationID(key))
+		if thenable.Error != nil {
+			log.Errorf("cron job %s: %v", job.Name, thenable.Error)
+		}
+	}
+}
+
+// tickKey is the same for a tick in every instance
+func tickKey(name string, at time.Time) string {
+	return fmt.Sprintf("cron:%s:%d", name, at.Unix())
+}
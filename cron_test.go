@@ -0,0 +1,167 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestScheduler(queue SQSQueue, now time.Time) *Scheduler {
+	scheduler := NewScheduler(queue)
+	scheduler.now = func() time.Time {
+		return now
+	}
+
+	return scheduler
+}
+
+/*
+	Case 1: the job is sent at its tick with a key deterministic per tick
+*/
+func Test_Scheduler_tick(t *testing.T) {
+	session := &MockAWSSessionThen{}
+	start := time.Date(2021, 3, 1, 10, 30, 0, 0, time.UTC)
+	scheduler := newTestScheduler(NewSQSQueue(session, "requests"), start)
+
+	assert.Nil(t, scheduler.AddJob("sync-contacts", "@hourly", "contacts.sync", "all"))
+
+	next, ok := scheduler.Next("sync-contacts")
+	assert.True(t, ok)
+	assert.Equal(t, start.Add(30*time.Minute), next)
+
+	scheduler.tick(start.Add(10 * time.Minute))
+	assert.Nil(t, session.input)
+
+	scheduler.tick(start.Add(30*time.Minute + 5*time.Second))
+	assert.Equal(t, "contacts.sync", *session.input.MessageAttributes["Method"].StringValue)
+	assert.Equal(t, tickKey("sync-contacts", start.Add(30*time.Minute)), attributeOf(session.input, "IdempotencyKey"))
+	assert.Nil(t, session.input.MessageDeduplicationId)
+	assert.NotContains(t, attributesOf(session.input), deduplicationIDAttr)
+
+	next, _ = scheduler.Next("sync-contacts")
+	assert.Equal(t, start.Add(90*time.Minute), next)
+
+	/*
+		Another instance sends the same tick with the same key
+	*/
+	other := &MockAWSSessionThen{}
+	otherScheduler := newTestScheduler(NewSQSQueue(other, "requests"), start)
+	assert.Nil(t, otherScheduler.AddJob("sync-contacts", "@hourly", "contacts.sync", "all"))
+
+	otherScheduler.tick(start.Add(30*time.Minute + 7*time.Second))
+	assert.Equal(t, attributeOf(session.input, "IdempotencyKey"), attributeOf(other.input, "IdempotencyKey"))
+}
+
+/*
+	Case 2: a job that missed several ticks runs once, for the last one
+*/
+func Test_Scheduler_missed_ticks(t *testing.T) {
+	session := &MockAWSSessionThen{}
+	start := time.Date(2021, 3, 1, 10, 30, 0, 0, time.UTC)
+	scheduler := newTestScheduler(NewSQSQueue(session, "requests"), start)
+
+	assert.Nil(t, scheduler.AddJob("report", "0 * * * *", "report.send", nil))
+
+	scheduler.tick(start.Add(3 * time.Hour))
+	assert.Equal(t, tickKey("report", start.Add(150*time.Minute)), attributeOf(session.input, "IdempotencyKey"))
+
+	entries := scheduler.Entries()
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, start.Add(150*time.Minute), entries[0].Prev)
+	assert.Equal(t, start.Add(210*time.Minute), entries[0].Next)
+}
+
+/*
+	Case 3: wrong specs and repeated names are errors
+*/
+func Test_Scheduler_AddJob_errors(t *testing.T) {
+	scheduler := NewScheduler(NewSQSQueue(&MockAWSSessionThen{}, "requests"))
+
+	assert.NotNil(t, scheduler.AddJob("job", "not a spec", "method", nil))
+	assert.Nil(t, scheduler.AddJob("job", "*/5 * * * *", "method", nil))
+	assert.Equal(t, ErrorCronJobExists, scheduler.AddJob("job", "@daily", "method", nil))
+
+	scheduler.RemoveJob("job")
+	_, ok := scheduler.Next("job")
+	assert.False(t, ok)
+}
+
+/*
+	Case 4: Run ends with Stop
+*/
+func Test_Scheduler_Stop(t *testing.T) {
+	scheduler := NewScheduler(NewSQSQueue(&MockAWSSessionThen{}, "requests"))
+	done := make(chan bool)
+
+	go func() {
+		scheduler.Run()
+		done <- true
+	}()
+
+	scheduler.Stop()
+	scheduler.Stop()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Run didn't stop")
+	}
+}
+
+/*
+	Case 5: Run wakes up for a job added while it waits for a later one
+*/
+func Test_Scheduler_Run_wakes_on_AddJob(t *testing.T) {
+	session := &Mock4EncryptAWSSession{sent: make(chan *sqs.SendMessageInput, 1)}
+	scheduler := NewScheduler(NewSQSQueue(session, "requests"))
+	defer scheduler.Stop()
+
+	assert.Nil(t, scheduler.AddJob("daily", "@daily", "reports.daily", nil))
+
+	go scheduler.Run()
+
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, scheduler.AddJob("often", "@every 1s", "contacts.sync", nil))
+
+	select {
+	case input := <-session.sent:
+		assert.Equal(t, "contacts.sync", *input.MessageAttributes["Method"].StringValue)
+	case <-time.After(3 * time.Second):
+		t.Error("Run didn't wake up for the new job")
+	}
+}
+
+/*
+	Case 6: on a FIFO queue the messages of a tick carry the same MessageDeduplicationId
+*/
+func Test_Scheduler_tick_fifo(t *testing.T) {
+	session := &MockAWSSessionThen{}
+	start := time.Date(2021, 3, 1, 10, 30, 0, 0, time.UTC)
+	scheduler := newTestScheduler(NewSQSQueue(session, "requests.fifo"), start)
+
+	assert.Nil(t, scheduler.AddJob("sync-contacts", "@hourly", "contacts.sync", "all"))
+	scheduler.tick(start.Add(30 * time.Minute))
+
+	key := tickKey("sync-contacts", start.Add(30*time.Minute))
+	assert.Equal(t, key, aws.StringValue(session.input.MessageDeduplicationId))
+	assert.Equal(t, "contacts.sync", aws.StringValue(session.input.MessageGroupId))
+	assert.Nil(t, session.input.DelaySeconds)
+	assert.NotContains(t, session.input.MessageAttributes, deduplicationIDAttr)
+}
+
+/*
+	Case 7: a FIFO queue refuses the delayed sends instead of sending them at once
+*/
+func Test_put_fifo_delay(t *testing.T) {
+	session := &MockAWSSessionThen{}
+	queue := NewSQSQueue(session, "requests.fifo")
+
+	assert.Equal(t, ErrorFIFODelayNotSupported, queue.PutJSON("contacts.sync", "all", 30, DeduplicationID("key")).Error)
+	assert.Nil(t, session.input)
+
+	assert.Nil(t, queue.PutJSON("contacts.sync", "all", 0, DeduplicationID("key")).Error)
+	assert.Nil(t, session.input.DelaySeconds)
+}
@@ -0,0 +1,373 @@
+package queue
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+
+	// nolint: depguard
+	log "github.com/sirupsen/logrus"
+)
+
+// dedupClaimSecondsDefault is how long a claim lasts if its handler neither
+// completes nor releases it
+const dedupClaimSecondsDefault = 300
+
+// sqlIdentifier matches a table name, optionally qualified by its schema
+var sqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// DedupStore remembers the idempotency keys of the messages already handled
+// with success. A handler claims the key before running, so two copies of the
+// message don't run at once. Then the key is completed, or released if the
+// handler failed. A claim not completed nor released expires, in case its
+// listener died
+type DedupStore interface {
+	Claim(key string) error
+	Complete(key string) error
+	Release(key string) error
+}
+
+// IdempotencyKey sets the key that identifies the operation of the message.
+// With a dedup store, the listener skips and deletes the messages whose key
+// already completed
+func IdempotencyKey(key string) PutOption {
+	return func(messageAttributes map[string]*sqs.MessageAttributeValue) {
+		messageAttributes["IdempotencyKey"] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(key),
+		}
+	}
+}
+
+// WithDedupStore sets the store the listener consults before calling a handler
+func WithDedupStore(store DedupStore) Option {
+	return func(q *queueSQS) {
+		q.Dedup = store
+	}
+}
+
+func idempotencyKey(m *sqs.Message) string {
+	if keyAttr, ok := m.MessageAttributes["IdempotencyKey"]; ok && keyAttr != nil {
+		return aws.StringValue(keyAttr.StringValue)
+	}
+
+	return ""
+}
+
+// claim takes the key of m for its handler. It returns
+// ErrorIdempotencyKeyCompleted if the operation already completed, and
+// ErrorIdempotencyKeyClaimed if another handler is running it
+func (q *queueSQS) claim(m *sqs.Message) error {
+	key := idempotencyKey(m)
+	if key == "" || q.Dedup == nil {
+		return nil
+	}
+
+	err := q.Dedup.Claim(key)
+	if err == nil || err == ErrorIdempotencyKeyCompleted || err == ErrorIdempotencyKeyClaimed {
+		return err
+	}
+
+	return errors.Wrapf(err, "claiming idempotency key %s", key)
+}
+
+// completed records the key of m, once its handler succeeded
+func (q *queueSQS) completed(m *sqs.Message) error {
+	key := idempotencyKey(m)
+	if key == "" || q.Dedup == nil {
+		return nil
+	}
+
+	return errors.Wrapf(q.Dedup.Complete(key), "completing idempotency key %s", key)
+}
+
+// unclaim gives back the key of m, once its handler failed
+func (q *queueSQS) unclaim(m *sqs.Message) {
+	key := idempotencyKey(m)
+	if key == "" || q.Dedup == nil {
+		return
+	}
+
+	if err := q.Dedup.Release(key); err != nil {
+		log.Errorf("releasing idempotency key %s: %v", key, err)
+	}
+}
+
+type dedupEntry struct {
+	key       string
+	completed bool
+	at        time.Time
+	element   *list.Element
+}
+
+type memoryDedupStore struct {
+	TTL         time.Duration
+	mutex       sync.Mutex
+	keys        map[string]*dedupEntry
+	claims      *list.List
+	completions *list.List
+}
+
+// NewMemoryDedupStore returns a DedupStore for a single process. The keys are
+// forgotten ttl after they completed
+func NewMemoryDedupStore(ttl time.Duration) DedupStore {
+	return &memoryDedupStore{
+		TTL:         ttl,
+		keys:        map[string]*dedupEntry{},
+		claims:      list.New(),
+		completions: list.New(),
+	}
+}
+
+// expire forgets the claims and the completions that no longer count. Each
+// kind lasts the same, so each list is kept from the oldest and only the
+// expired entries are visited
+func (s *memoryDedupStore) expire(now time.Time) {
+	s.expireList(s.claims, now.Add(-dedupClaimSecondsDefault*time.Second))
+	s.expireList(s.completions, now.Add(-s.TTL))
+}
+
+func (s *memoryDedupStore) expireList(entries *list.List, before time.Time) {
+	for front := entries.Front(); front != nil; front = entries.Front() {
+		oldest := front.Value.(*dedupEntry)
+		if !oldest.at.Before(before) {
+			break
+		}
+
+		s.remove(oldest)
+	}
+}
+
+func (s *memoryDedupStore) remove(entry *dedupEntry) {
+	if entry.completed {
+		s.completions.Remove(entry.element)
+	} else {
+		s.claims.Remove(entry.element)
+	}
+
+	delete(s.keys, entry.key)
+}
+
+// add records key as claimed or completed at now
+func (s *memoryDedupStore) add(key string, completed bool, now time.Time) {
+	if entry, ok := s.keys[key]; ok {
+		s.remove(entry)
+	}
+
+	entry := &dedupEntry{key: key, completed: completed, at: now}
+	if completed {
+		entry.element = s.completions.PushBack(entry)
+	} else {
+		entry.element = s.claims.PushBack(entry)
+	}
+
+	s.keys[key] = entry
+}
+
+func (s *memoryDedupStore) Claim(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	s.expire(now)
+
+	if entry, ok := s.keys[key]; ok {
+		if entry.completed {
+			return ErrorIdempotencyKeyCompleted
+		}
+
+		return ErrorIdempotencyKeyClaimed
+	}
+
+	s.add(key, false, now)
+
+	return nil
+}
+
+func (s *memoryDedupStore) Complete(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.add(key, true, time.Now())
+
+	return nil
+}
+
+func (s *memoryDedupStore) Release(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if entry, ok := s.keys[key]; ok && !entry.completed {
+		s.remove(entry)
+	}
+
+	return nil
+}
+
+// The script deletes the key only while it's a claim, a completion stays
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == "claimed" then
+	return redis.call("DEL", KEYS[1])
+end
+
+return 0
+`)
+
+type redisDedupStore struct {
+	Redis redis.UniversalClient
+	TTL   time.Duration
+}
+
+// NewRedisDedupStore returns a DedupStore shared by every process connected to
+// the same Redis. The keys expire ttl after they completed
+func NewRedisDedupStore(client redis.UniversalClient, ttl time.Duration) DedupStore {
+	return &redisDedupStore{
+		Redis: client,
+		TTL:   ttl,
+	}
+}
+
+func (s *redisDedupStore) Claim(key string) error {
+	ctx := context.Background()
+
+	claimed, err := s.Redis.SetNX(ctx, "sqs-idempotency:"+key, "claimed", dedupClaimSecondsDefault*time.Second).Result()
+	if err != nil {
+		return errors.Wrap(err, "Redis SET NX error")
+	}
+
+	if claimed {
+		return nil
+	}
+
+	value, err := s.Redis.Get(ctx, "sqs-idempotency:"+key).Result()
+	if err == redis.Nil {
+		// it expired in between, the next attempt claims it
+		return ErrorIdempotencyKeyClaimed
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "Redis GET error")
+	}
+
+	if value == "completed" {
+		return ErrorIdempotencyKeyCompleted
+	}
+
+	return ErrorIdempotencyKeyClaimed
+}
+
+func (s *redisDedupStore) Complete(key string) error {
+	if err := s.Redis.Set(context.Background(), "sqs-idempotency:"+key, "completed", s.TTL).Err(); err != nil {
+		return errors.Wrap(err, "Redis SET error")
+	}
+
+	return nil
+}
+
+func (s *redisDedupStore) Release(key string) error {
+	if err := releaseScript.Run(context.Background(), s.Redis, []string{"sqs-idempotency:" + key}).Err(); err != nil {
+		return errors.Wrap(err, "Redis release script error")
+	}
+
+	return nil
+}
+
+type sqlDedupStore struct {
+	DB    *sql.DB
+	Table string
+	TTL   time.Duration
+}
+
+// NewSQLDedupStore returns a DedupStore kept in table, that must have the columns
+//
+//	idempotency_key VARCHAR(255) PRIMARY KEY
+//	claimed_at      TIMESTAMP NOT NULL
+//	completed_at    TIMESTAMP NULL
+//
+// The queries use ? placeholders, as MySQL and SQLite do. The keys are ignored
+// ttl after they completed, deleting them is up to the owner of the table. The
+// name of the table goes into the queries, so it must be an identifier
+func NewSQLDedupStore(db *sql.DB, table string, ttl time.Duration) (DedupStore, error) {
+	if !sqlIdentifier.MatchString(table) {
+		return nil, ErrorTableNameInvalid
+	}
+
+	return &sqlDedupStore{
+		DB:    db,
+		Table: table,
+		TTL:   ttl,
+	}, nil
+}
+
+func (s *sqlDedupStore) Claim(key string) error {
+	now := time.Now().UTC()
+
+	_, insertErr := s.DB.Exec("INSERT INTO "+s.Table+" (idempotency_key, claimed_at) VALUES (?, ?)", key, now)
+	if insertErr == nil {
+		return nil
+	}
+
+	/*
+		The key is already there, or the insert failed for another reason
+	*/
+
+	claimedAt := time.Time{}
+	completedAt := sql.NullTime{}
+	err := s.DB.QueryRow("SELECT claimed_at, completed_at FROM "+s.Table+" WHERE idempotency_key = ?", key).Scan(&claimedAt, &completedAt)
+
+	if err == sql.ErrNoRows {
+		return errors.Wrap(insertErr, "SQL insert error")
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "SQL select error")
+	}
+
+	if completedAt.Valid && time.Since(completedAt.Time) <= s.TTL {
+		return ErrorIdempotencyKeyCompleted
+	}
+
+	if !completedAt.Valid && time.Since(claimedAt) <= dedupClaimSecondsDefault*time.Second {
+		return ErrorIdempotencyKeyClaimed
+	}
+
+	/*
+		The completion or the claim expired. Only one of the handlers that saw
+		it takes the key, the one whose update finds it as it was
+	*/
+
+	result, err := s.DB.Exec("UPDATE "+s.Table+" SET claimed_at = ?, completed_at = NULL WHERE idempotency_key = ? AND claimed_at = ?", now, key, claimedAt)
+	if err != nil {
+		return errors.Wrap(err, "SQL update error")
+	}
+
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return ErrorIdempotencyKeyClaimed
+	}
+
+	return nil
+}
+
+func (s *sqlDedupStore) Complete(key string) error {
+	if _, err := s.DB.Exec("UPDATE "+s.Table+" SET completed_at = ? WHERE idempotency_key = ?", time.Now().UTC(), key); err != nil {
+		return errors.Wrap(err, "SQL update error")
+	}
+
+	return nil
+}
+
+func (s *sqlDedupStore) Release(key string) error {
+	if _, err := s.DB.Exec("DELETE FROM "+s.Table+" WHERE idempotency_key = ? AND completed_at IS NULL", key); err != nil {
+		return errors.Wrap(err, "SQL delete error")
+	}
+
+	return nil
+}
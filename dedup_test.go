@@ -0,0 +1,229 @@
+package queue
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/go-redis/redis/v8"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+	Case 1: a message whose key already completed is skipped
+*/
+func Test_IdempotencyKey_skips_duplicate(t *testing.T) {
+	session := &Mock4ReplyAWSSession{}
+	queue := NewSQSQueue(session, "requests", WithDedupStore(NewMemoryDedupStore(time.Hour)))
+
+	charged := make(chan interface{}, 2)
+	marked := make(chan bool, 1)
+
+	queue.Register("charge", func(msg interface{}) error {
+		charged <- msg
+		return nil
+	})
+	queue.Register("mark", func(msg interface{}) error {
+		marked <- true
+		return nil
+	})
+
+	go queue.Listen()
+
+	assert.Nil(t, queue.PutJSON("charge", "order-1", 0, IdempotencyKey("order-1")).Error)
+	assert.Equal(t, "order-1", <-charged)
+
+	assert.Nil(t, queue.PutJSON("charge", "order-1 again", 0, IdempotencyKey("order-1")).Error)
+	assert.Nil(t, queue.PutJSON("mark", "after the duplicate", 0).Error)
+	<-marked
+
+	select {
+	case msg := <-charged:
+		t.Errorf("the duplicate %v was handled", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+/*
+	Case 2: a key is claimed while its handler runs, and released if it fails
+*/
+func Test_IdempotencyKey_retries_until_completed(t *testing.T) {
+	session := &Mock4ReplyAWSSession{}
+	store := NewMemoryDedupStore(time.Hour)
+	queue := NewSQSQueue(session, "requests", WithDedupStore(store))
+
+	calls := make(chan int, 2)
+	count := 0
+
+	queue.Register("charge", func(msg interface{}) error {
+		count++
+		calls <- count
+
+		if count == 1 {
+			assert.Equal(t, ErrorIdempotencyKeyClaimed, store.Claim("order-1"))
+			return assert.AnError
+		}
+
+		return nil
+	})
+
+	go queue.Listen()
+
+	assert.Nil(t, queue.PutJSON("charge", "order-1", 0, IdempotencyKey("order-1")).Error)
+	assert.Equal(t, 1, <-calls)
+	assert.Equal(t, 2, <-calls)
+}
+
+func testDedupStore(t *testing.T, store DedupStore) {
+	/*
+		Case 1: a key is claimed once, until it's released
+	*/
+	assert.Nil(t, store.Claim("key-1"))
+	assert.Equal(t, ErrorIdempotencyKeyClaimed, store.Claim("key-1"))
+
+	assert.Nil(t, store.Release("key-1"))
+	assert.Nil(t, store.Claim("key-1"))
+
+	/*
+		Case 2: a completed key can't be claimed nor released
+	*/
+	assert.Nil(t, store.Complete("key-1"))
+	assert.Nil(t, store.Release("key-1"))
+	assert.Equal(t, ErrorIdempotencyKeyCompleted, store.Claim("key-1"))
+
+	/*
+		Case 3: the keys are apart
+	*/
+	assert.Nil(t, store.Claim("key-2"))
+}
+
+func Test_memoryDedupStore(t *testing.T) {
+	testDedupStore(t, NewMemoryDedupStore(time.Hour))
+
+	/*
+		Case: the keys expire
+	*/
+	store := NewMemoryDedupStore(0)
+	assert.Nil(t, store.Claim("key-1"))
+	assert.Nil(t, store.Complete("key-1"))
+
+	time.Sleep(time.Millisecond)
+
+	assert.Nil(t, store.Claim("key-1"))
+
+	/*
+		Case: the expired completions are dropped, the claims last longer
+	*/
+	assert.Nil(t, store.Complete("key-2"))
+
+	time.Sleep(time.Millisecond)
+
+	assert.Nil(t, store.Claim("key-3"))
+
+	memory := store.(*memoryDedupStore)
+	assert.Equal(t, 2, len(memory.keys))
+	assert.Equal(t, 2, memory.claims.Len())
+	assert.Equal(t, 0, memory.completions.Len())
+}
+
+func Test_redisDedupStore(t *testing.T) {
+	server, err := miniredis.Run()
+	assert.Nil(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+
+	testDedupStore(t, NewRedisDedupStore(client, time.Hour))
+}
+
+func Test_sqlDedupStore(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	assert.Nil(t, err)
+	defer db.Close()
+
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec("CREATE TABLE idempotency_keys (idempotency_key VARCHAR(255) PRIMARY KEY, claimed_at TIMESTAMP NOT NULL, completed_at TIMESTAMP NULL)")
+	assert.Nil(t, err)
+
+	store, err := NewSQLDedupStore(db, "idempotency_keys", time.Hour)
+	assert.Nil(t, err)
+
+	testDedupStore(t, store)
+
+	/*
+		Case: an expired completion is claimed again
+	*/
+	store, err = NewSQLDedupStore(db, "idempotency_keys", 0)
+	assert.Nil(t, err)
+
+	time.Sleep(time.Millisecond)
+	assert.Nil(t, store.Claim("key-1"))
+	assert.Equal(t, ErrorIdempotencyKeyClaimed, store.Claim("key-1"))
+}
+
+/*
+	Case 3: the table name must be an identifier, it goes into the queries
+*/
+func Test_NewSQLDedupStore_invalid_table(t *testing.T) {
+	for _, table := range []string{"", "keys; DROP TABLE users", "1keys", "keys--"} {
+		_, err := NewSQLDedupStore(nil, table, time.Hour)
+		assert.Equal(t, ErrorTableNameInvalid, err, table)
+	}
+
+	_, err := NewSQLDedupStore(nil, "public.idempotency_keys", time.Hour)
+	assert.Nil(t, err)
+}
+
+/*
+	Case 4: a duplicate skipped removes its offloaded body
+*/
+func Test_IdempotencyKey_duplicate_removes_blob(t *testing.T) {
+	session := &Mock4handleMessageAWSSession{}
+	store := NewMemoryDedupStore(time.Hour)
+	blobs := &Mock4BlobAWSSession{
+		objects: map[string][]byte{"bucket/key": []byte(`{"msg":"order-1"}`)},
+		deleted: make(chan bool, 1),
+	}
+
+	queue := queueSQS{
+		queueConfig: queueConfig{
+			Blobs: NewS3BlobStore(blobs, "bucket"),
+			Dedup: store,
+		},
+		requests:  &requests{},
+		SQS:       session,
+		msgIDerrs: map[string]int{},
+	}
+
+	assert.Nil(t, store.Claim("order-1"))
+	assert.Nil(t, store.Complete("order-1"))
+
+	msg := sqs.Message{}
+	msg.Body = aws.String("key")
+	msg.ReceiptHandle = aws.String("a receipt handle")
+	msg.MD5OfBody = aws.String("messageID")
+	msg.MessageAttributes = map[string]*sqs.MessageAttributeValue{
+		"BlobKey": {
+			DataType:    aws.String("String"),
+			StringValue: aws.String("key"),
+		},
+		"IdempotencyKey": {
+			DataType:    aws.String("String"),
+			StringValue: aws.String("order-1"),
+		},
+	}
+
+	assert.Nil(t, queue.handleMessage(func(msg interface{}) error {
+		t.Error("the duplicate was handled")
+		return nil
+	}, &msg))
+
+	<-blobs.deleted
+	assert.Empty(t, blobs.objects)
+}
@@ -0,0 +1,235 @@
+package queue
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/pkg/errors"
+)
+
+const dataKeyBytes = 32
+
+// KeyProvider issues and unwraps the data keys used to encrypt message bodies.
+// keyID identifies the master key, so old messages can be decrypted after a rotation.
+// DecryptDataKey returns ErrorKeyNotFound or ErrorDecryptionFailed when the data
+// key can never be unwrapped, any other error is retried
+type KeyProvider interface {
+	GenerateDataKey(keyID string) (plaintext, ciphertext []byte, err error)
+	DecryptDataKey(keyID string, ciphertext []byte) ([]byte, error)
+}
+
+// iKMSSession represents the interface to connect to KMS
+type iKMSSession interface {
+	GenerateDataKey(input *kms.GenerateDataKeyInput) (*kms.GenerateDataKeyOutput, error)
+	Decrypt(input *kms.DecryptInput) (*kms.DecryptOutput, error)
+}
+
+type kmsKeyProvider struct {
+	KMS iKMSSession
+}
+
+// NewKMSKeyProvider returns a KeyProvider whose master keys live in KMS
+func NewKMSKeyProvider(kmssession iKMSSession) KeyProvider {
+	return &kmsKeyProvider{
+		KMS: kmssession,
+	}
+}
+
+func (p *kmsKeyProvider) GenerateDataKey(keyID string) ([]byte, []byte, error) {
+	params := kms.GenerateDataKeyInput{
+		KeyId:   aws.String(keyID),
+		KeySpec: aws.String(kms.DataKeySpecAes256),
+	}
+
+	response, err := p.KMS.GenerateDataKey(&params)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "KMS.GenerateDataKey error")
+	}
+
+	return response.Plaintext, response.CiphertextBlob, nil
+}
+
+func (p *kmsKeyProvider) DecryptDataKey(keyID string, ciphertext []byte) ([]byte, error) {
+	params := kms.DecryptInput{
+		KeyId:          aws.String(keyID),
+		CiphertextBlob: ciphertext,
+	}
+
+	response, err := p.KMS.Decrypt(&params)
+	if err != nil {
+		return nil, errors.Wrap(err, "KMS.Decrypt error")
+	}
+
+	return response.Plaintext, nil
+}
+
+type staticKeyProvider struct {
+	Keys map[string][]byte
+}
+
+// NewStaticKeyProvider returns a KeyProvider that wraps the data keys with the
+// given 32 bytes master keys, indexed by their keyID
+func NewStaticKeyProvider(keys map[string][]byte) KeyProvider {
+	return &staticKeyProvider{
+		Keys: keys,
+	}
+}
+
+func (p *staticKeyProvider) GenerateDataKey(keyID string) ([]byte, []byte, error) {
+	masterKey, ok := p.Keys[keyID]
+	if !ok {
+		return nil, nil, ErrorKeyNotFound
+	}
+
+	plaintext := make([]byte, dataKeyBytes)
+	if _, err := io.ReadFull(rand.Reader, plaintext); err != nil {
+		return nil, nil, err
+	}
+
+	ciphertext, err := seal(masterKey, plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return plaintext, ciphertext, nil
+}
+
+func (p *staticKeyProvider) DecryptDataKey(keyID string, ciphertext []byte) ([]byte, error) {
+	masterKey, ok := p.Keys[keyID]
+	if !ok {
+		return nil, ErrorKeyNotFound
+	}
+
+	plaintext, err := open(masterKey, ciphertext)
+	if err != nil {
+		return nil, errors.Wrap(ErrorDecryptionFailed, err.Error())
+	}
+
+	return plaintext, nil
+}
+
+// WithEncryption encrypts the body of every message put into the queue with a
+// data key issued by provider under the master key keyID
+func WithEncryption(provider KeyProvider, keyID string) Option {
+	return func(q *queueSQS) {
+		q.Keys = provider
+		q.KeyID = keyID
+	}
+}
+
+// encrypt seals data with a fresh data key, the wrapped data key and its keyID go in the attributes
+func (q *queueSQS) encrypt(data []byte, messageAttributes map[string]*sqs.MessageAttributeValue) ([]byte, error) {
+	if q.Keys == nil {
+		return data, nil
+	}
+
+	plaintext, ciphertext, err := q.Keys.GenerateDataKey(q.KeyID)
+	if err != nil {
+		return nil, errors.Wrap(err, "generating data key")
+	}
+
+	sealed, err := seal(plaintext, data)
+	if err != nil {
+		return nil, errors.Wrap(err, "encrypting message body")
+	}
+
+	messageAttributes["KeyID"] = &sqs.MessageAttributeValue{
+		DataType:    aws.String("String"),
+		StringValue: aws.String(q.KeyID),
+	}
+	messageAttributes["EncryptedDataKey"] = &sqs.MessageAttributeValue{
+		DataType:    aws.String("String"),
+		StringValue: aws.String(base64.StdEncoding.EncodeToString(ciphertext)),
+	}
+
+	return sealed, nil
+}
+
+// decrypt reverts encrypt. Messages without KeyID are returned as they came
+func (q *queueSQS) decrypt(data []byte, m *sqs.Message) ([]byte, error) {
+	keyIDAttr, ok := m.MessageAttributes["KeyID"]
+	if !ok || keyIDAttr == nil {
+		return data, nil
+	}
+
+	if q.Keys == nil {
+		return nil, errors.Wrap(ErrorDecryptionFailed, "there is no key provider")
+	}
+
+	dataKeyAttr, ok := m.MessageAttributes["EncryptedDataKey"]
+	if !ok || dataKeyAttr == nil {
+		return nil, errors.Wrap(ErrorDecryptionFailed, "EncryptedDataKey not found")
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(aws.StringValue(dataKeyAttr.StringValue))
+	if err != nil {
+		return nil, errors.Wrap(ErrorDecryptionFailed, err.Error())
+	}
+
+	plaintext, err := q.Keys.DecryptDataKey(aws.StringValue(keyIDAttr.StringValue), ciphertext)
+
+	switch cause := errors.Cause(err); {
+	case err == nil:
+	case cause == ErrorKeyNotFound, cause == ErrorDecryptionFailed:
+		return nil, errors.Wrap(ErrorDecryptionFailed, err.Error())
+	default:
+		/*
+			The provider may be unavailable for a while, so the message is retried
+		*/
+
+		return nil, errors.Wrap(err, "decrypting data key")
+	}
+
+	opened, err := open(plaintext, data)
+	if err != nil {
+		return nil, errors.Wrap(ErrorDecryptionFailed, err.Error())
+	}
+
+	return opened, nil
+}
+
+// seal encrypts data with AES-GCM, the nonce is prepended to the result
+func seal(key, data []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, data, nil), nil
+}
+
+// open reverts seal
+func open(key, data []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < aead.NonceSize() {
+		return nil, ErrorCiphertextShort
+	}
+
+	nonce, sealed := data[:aead.NonceSize()], data[aead.NonceSize():]
+
+	return aead.Open(nil, nonce, sealed, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
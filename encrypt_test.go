@@ -0,0 +1,196 @@
+package queue
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+)
+
+type Mock4EncryptAWSSession struct {
+	sent chan *sqs.SendMessageInput
+}
+
+func (a *Mock4EncryptAWSSession) SendMessage(input *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
+	if err := checkAttributes(len(input.MessageAttributes)); err != nil {
+		return nil, err
+	}
+
+	a.sent <- input
+	return &sqs.SendMessageOutput{
+		MessageId:        aws.String("messageID"),
+		MD5OfMessageBody: aws.String("messageID"),
+	}, nil
+}
+
+func (a *Mock4EncryptAWSSession) ReceiveMessage(input *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	return nil, nil
+}
+
+func (a *Mock4EncryptAWSSession) DeleteMessage(input *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
+	return nil, nil
+}
+
+// Mock4KMSSession wraps the data keys by reversing them
+type Mock4KMSSession struct {
+	KeyID string
+}
+
+func (a *Mock4KMSSession) GenerateDataKey(input *kms.GenerateDataKeyInput) (*kms.GenerateDataKeyOutput, error) {
+	a.KeyID = *input.KeyId
+	plaintext := bytes.Repeat([]byte{1, 2}, dataKeyBytes/2)
+
+	return &kms.GenerateDataKeyOutput{
+		Plaintext:      plaintext,
+		CiphertextBlob: reverse(plaintext),
+	}, nil
+}
+
+func (a *Mock4KMSSession) Decrypt(input *kms.DecryptInput) (*kms.DecryptOutput, error) {
+	if *input.KeyId != a.KeyID {
+		return nil, errors.New("key not found")
+	}
+
+	return &kms.DecryptOutput{
+		Plaintext: reverse(input.CiphertextBlob),
+	}, nil
+}
+
+func reverse(data []byte) []byte {
+	reversed := make([]byte, len(data))
+	for i := range data {
+		reversed[len(data)-1-i] = data[i]
+	}
+
+	return reversed
+}
+
+var (
+	testKey1 = bytes.Repeat([]byte{1}, dataKeyBytes)
+	testKey2 = bytes.Repeat([]byte{2}, dataKeyBytes)
+)
+
+/*
+	Case 1: the body is unreadable in the queue and the listener gets it back
+*/
+func Test_encryption_static_key_roundtrip(t *testing.T) {
+	session := &MockAWSSessionThen{}
+	provider := NewStaticKeyProvider(map[string][]byte{"key-1": testKey1})
+	queue := NewSQSQueue(session, "", WithEncryption(provider, "key-1")).(*queueSQS)
+
+	expected := "a customer PII"
+	assert.Nil(t, queue.PutString("method", expected, 0).Error)
+	assert.NotContains(t, *session.input.MessageBody, expected)
+	assert.Equal(t, "key-1", attributeOf(session.input, "KeyID"))
+
+	actual, err := queue.decode(receivedMessage(session.input))
+	assert.Nil(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+/*
+	Case 2: after a rotation the messages sealed with the old key are still readable
+*/
+func Test_encryption_key_rotation(t *testing.T) {
+	session := &MockAWSSessionThen{}
+	keys := map[string][]byte{"key-1": testKey1}
+	before := NewSQSQueue(session, "", WithEncryption(NewStaticKeyProvider(keys), "key-1")).(*queueSQS)
+
+	assert.Nil(t, before.PutString("method", "a message", 0).Error)
+	old := receivedMessage(session.input)
+
+	keys["key-2"] = testKey2
+	after := NewSQSQueue(session, "", WithEncryption(NewStaticKeyProvider(keys), "key-2")).(*queueSQS)
+
+	assert.Nil(t, after.PutString("method", "a message", 0).Error)
+	assert.Equal(t, "key-2", attributeOf(session.input, "KeyID"))
+
+	actual, err := after.decode(old)
+	assert.Nil(t, err)
+	assert.Equal(t, "a message", actual)
+}
+
+/*
+	Case 3: the KMS provider asks KMS for the data keys
+*/
+func Test_encryption_kms_roundtrip(t *testing.T) {
+	session := &MockAWSSessionThen{}
+	kmssession := &Mock4KMSSession{}
+	queue := NewSQSQueue(session, "", WithEncryption(NewKMSKeyProvider(kmssession), "alias/queue"), WithCompression(EncodingGzip)).(*queueSQS)
+
+	expected := map[string]interface{}{"email": "someone@example.com"}
+	assert.Nil(t, queue.PutJSON("method", expected, 0).Error)
+	assert.Equal(t, "alias/queue", kmssession.KeyID)
+
+	actual, err := queue.decode(receivedMessage(session.input))
+	assert.Nil(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+/*
+	Case 4: a message that can't be decrypted goes to the dead-letter queue, not back to the queue
+*/
+func Test_handleMessage_decryption_failure_dead_letter(t *testing.T) {
+	session := &Mock4EncryptAWSSession{
+		sent: make(chan *sqs.SendMessageInput, 1),
+	}
+	queue := queueSQS{
+		queueConfig: queueConfig{
+			Keys:          NewStaticKeyProvider(map[string][]byte{"key-1": testKey1}),
+			KeyID:         "key-1",
+			DeadLetterURL: "dead-letter",
+		},
+		requests:  &requests{},
+		SQS:       session,
+		URL:       "queue",
+		msgIDerrs: map[string]int{},
+	}
+
+	handler := func(msg interface{}) error {
+		t.Error("handler should not be called")
+		return nil
+	}
+
+	msg := sqs.Message{}
+	msg.Body = aws.String("bm90IGVuY3J5cHRlZA==")
+	msg.ReceiptHandle = aws.String("a receipt handle")
+	msg.MD5OfBody = aws.String("messageID")
+	msg.MessageAttributes = map[string]*sqs.MessageAttributeValue{
+		"KeyID": {
+			DataType:    aws.String("String"),
+			StringValue: aws.String("key-unknown"),
+		},
+		"EncryptedDataKey": {
+			DataType:    aws.String("String"),
+			StringValue: aws.String("a2V5"),
+		},
+	}
+
+	assert.Nil(t, queue.handleMessage(handler, &msg))
+
+	input := <-session.sent
+	assert.Equal(t, "dead-letter", *input.QueueUrl)
+	assert.Equal(t, *msg.Body, *input.MessageBody)
+	assert.Contains(t, *input.MessageAttributes["DeadLetterReason"].StringValue, ErrorDecryptionFailed.Error())
+}
+
+/*
+	Case 5: a provider error is retried, it isn't a decryption failure
+*/
+func Test_encryption_provider_error(t *testing.T) {
+	session := &MockAWSSessionThen{}
+	kmssession := &Mock4KMSSession{}
+	queue := NewSQSQueue(session, "", WithEncryption(NewKMSKeyProvider(kmssession), "alias/queue")).(*queueSQS)
+
+	assert.Nil(t, queue.PutJSON("method", "a message", 0).Error)
+
+	kmssession.KeyID = "alias/unavailable"
+
+	_, err := queue.decode(receivedMessage(session.input))
+	assert.NotNil(t, err)
+	assert.NotContains(t, err.Error(), ErrorDecryptionFailed.Error())
+}
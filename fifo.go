@@ -0,0 +1,92 @@
+package queue
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+/*
+	These travel along the attributes until the message is sent, then they
+	become fields of the request, so they never reach the listener
+*/
+const (
+	deduplicationIDAttr = "x-deduplication-id"
+	messageGroupIDAttr  = "x-message-group-id"
+	fifoSuffix          = ".fifo"
+)
+
+// DeduplicationID sets the MessageDeduplicationId of the message. Only the FIFO
+// queues take it, the standard queues ignore it.
+//
+// The FIFO support is limited to puts like the ones of the Scheduler: sent with
+// no delay and deduplicated by this id. The listener retries, defers and hops
+// with delayed sends, that fail on a FIFO queue, and its resends don't carry the
+// id, so don't listen to a FIFO queue
+func DeduplicationID(id string) PutOption {
+	return func(messageAttributes map[string]*sqs.MessageAttributeValue) {
+		messageAttributes[deduplicationIDAttr] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(id),
+		}
+	}
+}
+
+// MessageGroupID sets the MessageGroupId of the message. Only the FIFO queues
+// take it, and there the method of the message is the group by default
+func MessageGroupID(id string) PutOption {
+	return func(messageAttributes map[string]*sqs.MessageAttributeValue) {
+		messageAttributes[messageGroupIDAttr] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(id),
+		}
+	}
+}
+
+// withFIFO moves the FIFO fields out of messageAttributes into params, if the
+// queue is FIFO. It returns the attributes left, or ErrorFIFODelayNotSupported
+// for a delayed send to a FIFO queue
+func withFIFO(params *sqs.SendMessageInput, messageAttributes map[string]*sqs.MessageAttributeValue) (map[string]*sqs.MessageAttributeValue, error) {
+	deduplicationAttr, hasDeduplication := messageAttributes[deduplicationIDAttr]
+	groupAttr, hasGroup := messageAttributes[messageGroupIDAttr]
+
+	if hasDeduplication || hasGroup {
+		attributes := map[string]*sqs.MessageAttributeValue{}
+		for name, attr := range messageAttributes {
+			if name != deduplicationIDAttr && name != messageGroupIDAttr {
+				attributes[name] = attr
+			}
+		}
+
+		messageAttributes = attributes
+	}
+
+	if !strings.HasSuffix(aws.StringValue(params.QueueUrl), fifoSuffix) {
+		return messageAttributes, nil
+	}
+
+	/*
+		The FIFO queues take a delay per queue, not per message. Dropping it
+		would send the retries and the deferrals at once, so refuse them
+	*/
+
+	if aws.Int64Value(params.DelaySeconds) > 0 {
+		return nil, ErrorFIFODelayNotSupported
+	}
+
+	params.DelaySeconds = nil
+
+	if hasDeduplication && deduplicationAttr != nil {
+		params.MessageDeduplicationId = deduplicationAttr.StringValue
+	}
+
+	switch {
+	case hasGroup && groupAttr != nil:
+		params.MessageGroupId = groupAttr.StringValue
+	case messageAttributes["Method"] != nil:
+		params.MessageGroupId = messageAttributes["Method"].StringValue
+	}
+
+	return messageAttributes, nil
+}
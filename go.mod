@@ -3,8 +3,16 @@ module github.com/rianby64/aws-sqs-poc
 go 1.13
 
 require (
+	github.com/alicebob/miniredis/v2 v2.14.3
 	github.com/aws/aws-sdk-go v1.37.1
+	github.com/go-redis/redis/v8 v8.4.11
+	github.com/klauspost/compress v1.11.13
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/pkg/errors v0.9.1
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/sirupsen/logrus v1.7.0
 	github.com/stretchr/testify v1.7.0
+	github.com/vmihailenco/msgpack/v5 v5.2.0
+	golang.org/x/net v0.0.0-20201202161906-c7110b5ffcbb
+	google.golang.org/protobuf v1.25.0
 )
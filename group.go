@@ -0,0 +1,429 @@
+package queue
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+
+	// nolint: depguard
+	log "github.com/sirupsen/logrus"
+)
+
+// GroupResult is the message the completion method of a group receives
+type GroupResult struct {
+	GroupID   string `json:"group_id"`
+	Total     int    `json:"total"`
+	Succeeded int    `json:"succeeded"`
+	Failed    int    `json:"failed"`
+}
+
+// GroupStore counts the members of the groups. Seal and Done return a result
+// only to the call that completes the group, so the completion runs once even
+// with several listeners. A member is done once, so a redelivered message
+// doesn't count twice. Add returns ErrorGroupSealed once the group is sealed
+type GroupStore interface {
+	Add(groupID, memberID string) error
+	Seal(groupID string) (*GroupResult, error)
+	Done(groupID, memberID string, succeeded bool) (*GroupResult, error)
+}
+
+// Group tags the messages put through it, the completion method is called once
+// the group is closed and every member has succeeded or failed for good
+type Group struct {
+	queue      *queueSQS
+	id         string
+	onComplete string
+}
+
+type groupAttr struct {
+	ID         string `json:"id"`
+	Member     string `json:"member"`
+	OnComplete string `json:"on_complete"`
+}
+
+// WithGroupStore sets the store that tracks the groups made by NewGroup
+func WithGroupStore(store GroupStore) Option {
+	return func(q *queueSQS) {
+		q.Groups = store
+	}
+}
+
+// NewGroup starts a group whose completion goes to the registered method onComplete
+func (q *queueSQS) NewGroup(onComplete string) *Group {
+	return &Group{
+		queue:      q,
+		id:         newID(),
+		onComplete: onComplete,
+	}
+}
+
+// ID returns the identifier of the group
+func (g *Group) ID() string {
+	return g.id
+}
+
+// PutString sends an string to the queue as a member of the group
+func (g *Group) PutString(method, msg string, delaySeconds int64, opts ...PutOption) *sqsResponseThenable {
+	return g.put(func(opts []PutOption) *sqsResponseThenable {
+		return g.queue.PutString(method, msg, delaySeconds, opts...)
+	}, msg, opts)
+}
+
+// PutJSON sends a JSON to the queue as a member of the group
+func (g *Group) PutJSON(method string, msg interface{}, delaySeconds int64, opts ...PutOption) *sqsResponseThenable {
+	return g.put(func(opts []PutOption) *sqsResponseThenable {
+		return g.queue.PutJSON(method, msg, delaySeconds, opts...)
+	}, msg, opts)
+}
+
+// Put sends msg to the queue as a member of the group
+func (g *Group) Put(method string, msg interface{}, delaySeconds int64, opts ...PutOption) *sqsResponseThenable {
+	return g.put(func(opts []PutOption) *sqsResponseThenable {
+		return g.queue.Put(method, msg, delaySeconds, opts...)
+	}, msg, opts)
+}
+
+func (g *Group) put(send func(opts []PutOption) *sqsResponseThenable, msg interface{}, opts []PutOption) *sqsResponseThenable {
+	if g.queue.Groups == nil {
+		thenable := &sqsResponseThenable{
+			queue: g.queue,
+			msg:   msg,
+			Error: ErrorGroupStoreNotSet,
+		}
+		thenable.settle(ErrorGroupStoreNotSet)
+
+		return thenable
+	}
+
+	member := newID()
+	if err := g.queue.Groups.Add(g.id, member); err != nil {
+		thenable := &sqsResponseThenable{
+			queue: g.queue,
+			msg:   msg,
+			Error: errors.Wrap(err, "adding group member"),
+		}
+		thenable.settle(thenable.Error)
+
+		return thenable
+	}
+
+	thenable := send(append(opts, withGroup(groupAttr{ID: g.id, Member: member, OnComplete: g.onComplete})))
+	if thenable.Error != nil {
+		/*
+			The member was counted, so it has to be done. It failed
+		*/
+
+		result, err := g.queue.Groups.Done(g.id, member, false)
+		if err == nil {
+			err = g.queue.completeGroup(g.onComplete, result)
+		}
+
+		if err != nil {
+			log.Errorf("group %s: %v", g.id, err)
+		}
+	}
+
+	return thenable
+}
+
+// Close tells that there are no more members. If all of them are done, the completion is sent now
+func (g *Group) Close() error {
+	if g.queue.Groups == nil {
+		return ErrorGroupStoreNotSet
+	}
+
+	result, err := g.queue.Groups.Seal(g.id)
+	if err != nil {
+		return errors.Wrap(err, "sealing group")
+	}
+
+	return g.queue.completeGroup(g.onComplete, result)
+}
+
+// groupDone counts m as done in its group, if any
+func (q *queueSQS) groupDone(m *sqs.Message, succeeded bool) {
+	attr, ok := m.MessageAttributes["Group"]
+	if !ok || attr == nil || q.Groups == nil {
+		return
+	}
+
+	group := groupAttr{}
+	if err := json.Unmarshal([]byte(aws.StringValue(attr.StringValue)), &group); err != nil {
+		log.Errorf("Incorrect value of Group: %v", err)
+		return
+	}
+
+	result, err := q.Groups.Done(group.ID, group.Member, succeeded)
+	if err != nil {
+		log.Errorf("group %s: %v", group.ID, err)
+		return
+	}
+
+	if err := q.completeGroup(group.OnComplete, result); err != nil {
+		log.Errorf("group %s: %v", group.ID, err)
+	}
+}
+
+// completeGroup sends the result to the completion method, result is nil if the group is not complete
+func (q *queueSQS) completeGroup(onComplete string, result *GroupResult) error {
+	if result == nil {
+		return nil
+	}
+
+	thenable := q.PutJSON(onComplete, result, 0)
+	if thenable.Error != nil {
+		return errors.Wrapf(thenable.Error, "sending to %s", onComplete)
+	}
+
+	return nil
+}
+
+func withGroup(group groupAttr) PutOption {
+	return func(messageAttributes map[string]*sqs.MessageAttributeValue) {
+		value, _ := json.Marshal(group) // two strings always marshal
+		messageAttributes["Group"] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(string(value)),
+		}
+	}
+}
+
+type groupCounts struct {
+	GroupResult
+	sealed   bool
+	notified bool
+	pending  map[string]bool
+	updated  time.Time
+	element  *list.Element
+}
+
+type memoryGroupStore struct {
+	TTL    time.Duration
+	mutex  sync.Mutex
+	groups map[string]*groupCounts
+	byAge  *list.List
+}
+
+// NewMemoryGroupStore returns a GroupStore for a single process. The groups
+// expire ttl after their last update
+func NewMemoryGroupStore(ttl time.Duration) (GroupStore, error) {
+	if ttl <= 0 {
+		return nil, ErrorGroupTTLInvalid
+	}
+
+	return &memoryGroupStore{
+		TTL:    ttl,
+		groups: map[string]*groupCounts{},
+		byAge:  list.New(),
+	}, nil
+}
+
+// group returns the group groupID, new if there is none. The groups are kept
+// from the least recently updated, so only the expired ones are visited
+func (s *memoryGroupStore) group(groupID string) *groupCounts {
+	now := time.Now()
+	for front := s.byAge.Front(); front != nil; front = s.byAge.Front() {
+		oldest := front.Value.(*groupCounts)
+		if now.Sub(oldest.updated) <= s.TTL {
+			break
+		}
+
+		s.byAge.Remove(front)
+		delete(s.groups, oldest.GroupID)
+	}
+
+	group, ok := s.groups[groupID]
+	if !ok {
+		group = &groupCounts{
+			GroupResult: GroupResult{
+				GroupID: groupID,
+			},
+			pending: map[string]bool{},
+		}
+		group.element = s.byAge.PushBack(group)
+		s.groups[groupID] = group
+	}
+
+	group.updated = now
+	s.byAge.MoveToBack(group.element)
+
+	return group
+}
+
+// complete returns the result if the group has just been completed
+func (s *memoryGroupStore) complete(group *groupCounts) *GroupResult {
+	if !group.sealed || group.notified || group.Succeeded+group.Failed < group.Total {
+		return nil
+	}
+
+	group.notified = true
+
+	result := group.GroupResult
+
+	return &result
+}
+
+func (s *memoryGroupStore) Add(groupID, memberID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	group := s.group(groupID)
+	if group.sealed {
+		return ErrorGroupSealed
+	}
+
+	if !group.pending[memberID] {
+		group.pending[memberID] = true
+		group.Total++
+	}
+
+	return nil
+}
+
+func (s *memoryGroupStore) Seal(groupID string) (*GroupResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	group := s.group(groupID)
+	group.sealed = true
+
+	return s.complete(group), nil
+}
+
+func (s *memoryGroupStore) Done(groupID, memberID string, succeeded bool) (*GroupResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	group := s.group(groupID)
+	if !group.pending[memberID] {
+		return nil, nil
+	}
+
+	delete(group.pending, memberID)
+
+	if succeeded {
+		group.Succeeded++
+	} else {
+		group.Failed++
+	}
+
+	return s.complete(group), nil
+}
+
+/*
+	The script updates the group and, in the same step, checks if that completed
+	the group. KEYS[1] is the group, KEYS[2] its pending members, ARGV[1] the
+	field to update, ARGV[2] the member and ARGV[3] the expiration in seconds.
+	A member is counted once when added and once when done
+*/
+var groupScript = redis.NewScript(`
+if ARGV[1] == "total" then
+	if redis.call("HGET", KEYS[1], "sealed") == "1" then
+		return "sealed"
+	end
+
+	if redis.call("SADD", KEYS[2], ARGV[2]) == 1 then
+		redis.call("HINCRBY", KEYS[1], "total", 1)
+	end
+elseif ARGV[1] == "sealed" then
+	redis.call("HSET", KEYS[1], "sealed", 1)
+elseif redis.call("SREM", KEYS[2], ARGV[2]) == 1 then
+	redis.call("HINCRBY", KEYS[1], ARGV[1], 1)
+else
+	return false
+end
+
+redis.call("EXPIRE", KEYS[1], ARGV[3])
+redis.call("EXPIRE", KEYS[2], ARGV[3])
+
+local group = redis.call("HMGET", KEYS[1], "total", "succeeded", "failed", "sealed", "notified")
+local total = tonumber(group[1] or 0)
+local succeeded = tonumber(group[2] or 0)
+local failed = tonumber(group[3] or 0)
+
+if tonumber(group[4] or 0) < 1 or group[5] == "1" or succeeded + failed < total then
+	return false
+end
+
+redis.call("HSET", KEYS[1], "notified", 1)
+
+return {total, succeeded, failed}
+`)
+
+type redisGroupStore struct {
+	Redis redis.UniversalClient
+	TTL   time.Duration
+}
+
+// NewRedisGroupStore returns a GroupStore shared by every process connected to
+// the same Redis. The groups expire ttl after their last update, that Redis
+// counts in seconds
+func NewRedisGroupStore(client redis.UniversalClient, ttl time.Duration) (GroupStore, error) {
+	if ttl < time.Second {
+		return nil, ErrorGroupTTLInvalid
+	}
+
+	return &redisGroupStore{
+		Redis: client,
+		TTL:   ttl,
+	}, nil
+}
+
+func (s *redisGroupStore) update(groupID, field, memberID string) (*GroupResult, error) {
+	// the braces keep both keys in the same slot of a Redis cluster
+	keys := []string{"sqs-group:{" + groupID + "}", "sqs-group:{" + groupID + "}:pending"}
+	values, err := groupScript.Run(context.Background(), s.Redis, keys, field, memberID, int64(s.TTL/time.Second)).Result()
+
+	if err == redis.Nil {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Redis group script error")
+	}
+
+	if values == "sealed" {
+		return nil, ErrorGroupSealed
+	}
+
+	counts, ok := values.([]interface{})
+	if !ok || len(counts) != 3 {
+		return nil, errors.Errorf("Redis group script returned %v", values)
+	}
+
+	result := &GroupResult{GroupID: groupID}
+	for i, count := range []*int{&result.Total, &result.Succeeded, &result.Failed} {
+		n, ok := counts[i].(int64)
+		if !ok {
+			return nil, errors.Errorf("Redis group script returned %v", values)
+		}
+
+		*count = int(n)
+	}
+
+	return result, nil
+}
+
+func (s *redisGroupStore) Add(groupID, memberID string) error {
+	_, err := s.update(groupID, "total", memberID)
+	return err
+}
+
+func (s *redisGroupStore) Seal(groupID string) (*GroupResult, error) {
+	return s.update(groupID, "sealed", "")
+}
+
+func (s *redisGroupStore) Done(groupID, memberID string, succeeded bool) (*GroupResult, error) {
+	if succeeded {
+		return s.update(groupID, "succeeded", memberID)
+	}
+
+	return s.update(groupID, "failed", memberID)
+}
@@ -0,0 +1,230 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+	Case 1: the completion method gets the counts once every member is done
+*/
+func Test_Group_completes(t *testing.T) {
+	session := &Mock4ReplyAWSSession{}
+	queue := NewSQSQueue(session, "requests", WithGroupStore(newTestGroupStore(t)))
+
+	completed := make(chan interface{}, 2)
+
+	queue.Register("resize", func(msg interface{}) error {
+		return nil
+	})
+	queue.Register("resize.done", func(msg interface{}) error {
+		completed <- msg
+		return nil
+	})
+
+	go queue.Listen()
+
+	group := queue.NewGroup("resize.done")
+	for _, image := range []string{"a.png", "b.png", "c.png"} {
+		assert.Nil(t, group.PutJSON("resize", image, 0).Error)
+	}
+	assert.Nil(t, group.Close())
+
+	select {
+	case msg := <-completed:
+		assert.Equal(t, map[string]interface{}{
+			"group_id":  group.ID(),
+			"total":     float64(3),
+			"succeeded": float64(3),
+			"failed":    float64(0),
+		}, msg)
+	case <-time.After(5 * time.Second):
+		t.Error("the group didn't complete")
+	}
+}
+
+/*
+	Case 2: the members of a chain are done at the end of the chain
+*/
+func Test_Group_chain_member(t *testing.T) {
+	session := &Mock4ReplyAWSSession{}
+	queue := NewSQSQueue(session, "requests", WithGroupStore(newTestGroupStore(t)))
+
+	steps := make(chan string, 2)
+	completed := make(chan interface{}, 1)
+
+	queue.Register("resize", func(msg interface{}) error {
+		steps <- "resize"
+		return nil
+	})
+	queue.Register("upload", func(msg interface{}) error {
+		steps <- "upload"
+		return nil
+	})
+	queue.Register("resize.done", func(msg interface{}) error {
+		completed <- msg
+		return nil
+	})
+
+	go queue.Listen()
+
+	group := queue.NewGroup("resize.done")
+	assert.Nil(t, group.PutJSON("resize", "a.png", 0, Then("upload")).Error)
+	assert.Nil(t, group.Close())
+
+	select {
+	case msg := <-completed:
+		assert.Equal(t, "resize", <-steps)
+		assert.Equal(t, "upload", <-steps)
+		assert.Equal(t, float64(1), msg.(map[string]interface{})["succeeded"])
+	case <-time.After(5 * time.Second):
+		t.Error("the group didn't complete")
+	}
+}
+
+/*
+	Case 3: without a group store the members can't be sent
+*/
+func Test_Group_store_not_set(t *testing.T) {
+	queue := NewSQSQueue(&Mock4ReplyAWSSession{}, "requests")
+
+	group := queue.NewGroup("resize.done")
+	assert.Equal(t, ErrorGroupStoreNotSet, group.PutJSON("resize", "a.png", 0).Error)
+	assert.Equal(t, ErrorGroupStoreNotSet, group.Close())
+}
+
+/*
+	Case 4: once closed, the group takes no more members
+*/
+func Test_Group_put_after_Close(t *testing.T) {
+	queue := NewSQSQueue(&Mock4ReplyAWSSession{}, "requests", WithGroupStore(newTestGroupStore(t)))
+
+	group := queue.NewGroup("resize.done")
+	assert.Nil(t, group.Close())
+
+	err := group.PutJSON("resize", "a.png", 0).Error
+	assert.Equal(t, ErrorGroupSealed, errors.Cause(err))
+}
+
+func testGroupStore(t *testing.T, store GroupStore) {
+	/*
+		Case 1: the group isn't complete until it is sealed
+	*/
+	assert.Nil(t, store.Add("group-1", "member-1"))
+	assert.Nil(t, store.Add("group-1", "member-2"))
+
+	result, err := store.Done("group-1", "member-1", true)
+	assert.Nil(t, err)
+	assert.Nil(t, result)
+
+	result, err = store.Done("group-1", "member-2", false)
+	assert.Nil(t, err)
+	assert.Nil(t, result)
+
+	result, err = store.Seal("group-1")
+	assert.Nil(t, err)
+	assert.Equal(t, &GroupResult{GroupID: "group-1", Total: 2, Succeeded: 1, Failed: 1}, result)
+
+	/*
+		Case 2: a sealed group completes with its last member, only once
+	*/
+	assert.Nil(t, store.Add("group-2", "member-1"))
+
+	result, err = store.Seal("group-2")
+	assert.Nil(t, err)
+	assert.Nil(t, result)
+
+	result, err = store.Done("group-2", "member-1", true)
+	assert.Nil(t, err)
+	assert.Equal(t, &GroupResult{GroupID: "group-2", Total: 1, Succeeded: 1}, result)
+
+	result, err = store.Seal("group-2")
+	assert.Nil(t, err)
+	assert.Nil(t, result)
+
+	/*
+		Case 3: a member redelivered is done only once
+	*/
+	assert.Nil(t, store.Add("group-3", "member-1"))
+	assert.Nil(t, store.Add("group-3", "member-2"))
+
+	result, err = store.Seal("group-3")
+	assert.Nil(t, err)
+	assert.Nil(t, result)
+
+	result, err = store.Done("group-3", "member-1", true)
+	assert.Nil(t, err)
+	assert.Nil(t, result)
+
+	result, err = store.Done("group-3", "member-1", true)
+	assert.Nil(t, err)
+	assert.Nil(t, result)
+
+	result, err = store.Done("group-3", "member-2", true)
+	assert.Nil(t, err)
+	assert.Equal(t, &GroupResult{GroupID: "group-3", Total: 2, Succeeded: 2}, result)
+
+	/*
+		Case 4: a sealed group takes no more members
+	*/
+	assert.Equal(t, ErrorGroupSealed, store.Add("group-3", "member-3"))
+}
+
+func newTestGroupStore(t *testing.T) GroupStore {
+	store, err := NewMemoryGroupStore(time.Hour)
+	assert.Nil(t, err)
+
+	return store
+}
+
+func Test_memoryGroupStore(t *testing.T) {
+	testGroupStore(t, newTestGroupStore(t))
+}
+
+/*
+	Case 5: the memory store drops the groups not updated within its TTL
+*/
+func Test_memoryGroupStore_expires(t *testing.T) {
+	groups, err := NewMemoryGroupStore(10 * time.Millisecond)
+	assert.Nil(t, err)
+
+	store := groups.(*memoryGroupStore)
+
+	assert.Nil(t, store.Add("group-1", "member-1"))
+	time.Sleep(20 * time.Millisecond)
+	assert.Nil(t, store.Add("group-2", "member-1"))
+
+	assert.NotContains(t, store.groups, "group-1")
+	assert.Contains(t, store.groups, "group-2")
+	assert.Equal(t, 1, store.byAge.Len())
+}
+
+func Test_redisGroupStore(t *testing.T) {
+	server, err := miniredis.Run()
+	assert.Nil(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+
+	store, err := NewRedisGroupStore(client, time.Hour)
+	assert.Nil(t, err)
+
+	testGroupStore(t, store)
+}
+
+/*
+	Case 6: the stores refuse a TTL that would expire the groups at once
+*/
+func Test_GroupStore_TTL_invalid(t *testing.T) {
+	_, err := NewMemoryGroupStore(0)
+	assert.Equal(t, ErrorGroupTTLInvalid, err)
+
+	_, err = NewRedisGroupStore(nil, time.Millisecond)
+	assert.Equal(t, ErrorGroupTTLInvalid, err)
+}
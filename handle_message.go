@@ -1,6 +1,7 @@
 package queue
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"strconv"
 	"time"
@@ -14,7 +15,14 @@ import (
 )
 
 // handleMessage - Performs work on a message with configured timeout.
-func (q *queueSQS) handleMessage(fn MessageHandler, m *sqs.Message) (err error) {
+func (q *queueSQS) handleMessage(fn MessageHandler, m *sqs.Message) error {
+	return q.handleReply(func(msg interface{}) (interface{}, error) {
+		return nil, fn(msg)
+	}, m)
+}
+
+// handleReply - Same as handleMessage, for handlers that return a result.
+func (q *queueSQS) handleReply(fn ReplyHandler, m *sqs.Message) (err error) {
 	params := sqs.DeleteMessageInput{
 		QueueUrl:      aws.String(q.URL),
 		ReceiptHandle: m.ReceiptHandle,
@@ -26,7 +34,32 @@ func (q *queueSQS) handleMessage(fn MessageHandler, m *sqs.Message) (err error)
 		timeoutSeconds = timeoutSecondsDefault
 	}
 
+	/*
+		With a worker pool, the message waits here for a free worker
+	*/
+
+	if q.workers != nil {
+		q.workers <- struct{}{}
+	}
+
 	go func() {
+		if q.workers != nil {
+			defer func() { <-q.workers }()
+		}
+
+		if !q.acquire(m) {
+			/*
+				The method is saturated, the message shows up again later
+				as it is, so its retries are kept as they were
+			*/
+
+			releaseWaitErr <- q.deferSaturated(m, &params)
+
+			return
+		}
+
+		defer q.release(m)
+
 		if _, err = q.SQS.DeleteMessage(&params); err != nil {
 			releaseWaitErr <- err // this is... a thing
 
@@ -41,6 +74,10 @@ func (q *queueSQS) handleMessage(fn MessageHandler, m *sqs.Message) (err error)
 
 		msgID := ""
 		if msgID, err = q.prepareMessageID(m); err != nil {
+			if err == ErrorRequestMaxRetries {
+				q.deadLetter(m, err)
+			}
+
 			releaseWaitErr <- err
 
 			return
@@ -54,36 +91,261 @@ func (q *queueSQS) handleMessage(fn MessageHandler, m *sqs.Message) (err error)
 			then resend it. Any further error only can be logged.
 		*/
 
-		msg := q.unmarshal(aws.StringValue(m.Body))
-		if err2 := fn(msg); err2 != nil {
-			log.Errorf("running handler error: %v", err2)
-			q.msgIDerrs[msgID]++
+		q.run(fn, m, msgID)
+	}()
 
-			if err2 := q.resendMessage(m); err2 != nil {
-				log.Errorf("resending messange to queue: %v", err2)
-			}
+	select {
+	case <-releaseWaitErr:
+		log.Info("Processed message from queue")
+		return err
+	case <-time.After(time.Second * time.Duration(timeoutSeconds)):
+		return ErrorDeleteMessageTimeout
+	}
+}
+
+// hopAhead sends a copy of m in its place if m isn't due yet. It tells whether
+// m was consumed
+func (q *queueSQS) hopAhead(m *sqs.Message, msgID string) bool {
+	hopped, err := q.hop(m)
+	if err != nil {
+		log.Errorf("scheduling message: %v", err)
+	}
+
+	if !hopped {
+		return false
+	}
+
+	/*
+		If the copy couldn't be sent, the message goes back as a retry
+	*/
+
+	if err != nil {
+		q.retry(m, msgID)
+		return true
+	}
+
+	q.forgetRetries(msgID)
+
+	return true
+}
+
+// run takes m, already deleted, through the gates and then to fn. Unless fn
+// succeeds, the idempotency key of m is given back for the retry
+func (q *queueSQS) run(fn ReplyHandler, m *sqs.Message, msgID string) {
+	if q.hopAhead(m, msgID) {
+		return
+	}
+
+	if q.skipDuplicate(m, msgID) {
+		return
+	}
+
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			q.unclaim(m)
+		}
+	}()
 
+	if q.holdBack(m, msgID) {
+		return
+	}
+
+	msg, result, ok := q.call(fn, m, msgID)
+	if !ok {
+		return
+	}
+
+	q.forgetRetries(msgID)
+	succeeded = true
+
+	q.succeed(m, msg, result)
+}
+
+// skipDuplicate claims the idempotency key of m. It tells whether m was
+// consumed: it's a duplicate, or it can't be told whether it is
+func (q *queueSQS) skipDuplicate(m *sqs.Message, msgID string) bool {
+	switch err := q.claim(m); err {
+	case nil:
+		return false
+	case ErrorIdempotencyKeyCompleted:
+		/*
+			The operation already completed, the message was deleted so it's acknowledged
+		*/
+
+		log.Infof("skipping duplicate message %s", idempotencyKey(m))
+		q.forgetRetries(msgID)
+
+		if err := q.removeBlob(m); err != nil {
+			log.Errorf("removing offloaded body: %v", err)
+		}
+	case ErrorIdempotencyKeyClaimed:
+		/*
+			Another copy is running, this one tries again later to see
+			whether it completed or failed. Its retries are kept as they were
+		*/
+
+		if err := q.requeue(m, concurrencyDelaySeconds); err != nil {
+			log.Errorf("deferring duplicate message: %v", err)
+			q.retry(m, msgID)
+		}
+	default:
+		/*
+			Without the store it's unknown if the operation already ran, so it waits for a retry
+		*/
+
+		log.Errorf("checking duplicate: %v", err)
+		q.retry(m, msgID)
+	}
+
+	return true
+}
+
+// holdBack defers m while the circuit of its method is open or its rate limit
+// is spent. It tells whether m was consumed. Deferred, m keeps its retries as
+// they were
+func (q *queueSQS) holdBack(m *sqs.Message, msgID string) bool {
+	opened, err := q.breakerOpen(m)
+	if opened {
+		if err != nil {
+			log.Errorf("deferring message: %v", err)
+			q.retry(m, msgID)
+		}
+
+		return true
+	}
+
+	throttled, err := q.throttle(m)
+	if err != nil {
+		log.Errorf("rate limiting: %v", err)
+	}
+
+	if !throttled {
+		return false
+	}
+
+	/*
+		The circuit is checked first, so the messages deferred while it's
+		open don't spend tokens
+	*/
+
+	q.breakerRelease(m)
+
+	if err != nil {
+		q.retry(m, msgID)
+	}
+
+	return true
+}
+
+// call decodes m and runs fn on it, recording the outcome on the circuit of
+// its method. Unless fn succeeds, m is retried or dead-lettered
+func (q *queueSQS) call(fn ReplyHandler, m *sqs.Message, msgID string) (msg, result interface{}, ok bool) {
+	msg, err := q.decode(m)
+	if err == nil {
+		result, err = fn(msg)
+
+		if IsPermanent(err) {
 			/*
-				In conclusion. If you put releaseWait at the end of this
-				function, surely it may end up in flooding the queue
+				The method isn't failing, the message is wrong
 			*/
 
-			return
+			q.breakerRecord(m, nil)
+		} else {
+			q.breakerRecord(m, err)
+		}
+	} else {
+		/*
+			The handler wasn't called, the failure to decode says nothing about the method
+		*/
+
+		q.breakerRelease(m)
+
+		if errors.Cause(err) == ErrorDecryptionFailed {
+			/*
+				There is no point in retrying a message that can't be decrypted
+			*/
+
+			q.forgetRetries(msgID)
+			q.deadLetter(m, err)
+
+			return nil, nil, false
 		}
+	}
+
+	if err != nil {
+		log.Errorf("running handler error: %v", err)
+		q.retryFailed(m, msgID, err)
+
+		/*
+			In conclusion. If you put releaseWait at the end of this
+			function, surely it may end up in flooding the queue
+		*/
+
+		return nil, nil, false
+	}
+
+	return msg, result, true
+}
+
+// succeed records the completion of m and takes its result on to the next step
+// and to the reply
+func (q *queueSQS) succeed(m *sqs.Message, msg, result interface{}) {
+	if err := q.completed(m); err != nil {
+		log.Errorf("recording completion: %v", err)
+	}
+
+	q.runThens(m, msg)
+
+	forwarded, err := q.continueChain(m, msg, result)
+	if err != nil {
+		log.Errorf("enqueuing next step: %v", err)
+		q.settle(m, nil, err)
+	}
+
+	if forwarded {
+		return
+	}
+
+	if err := q.removeBlob(m); err != nil {
+		log.Errorf("removing offloaded body: %v", err)
+	}
+}
+
+// decode turns the message into the value the handler receives
+func (q *queueSQS) decode(m *sqs.Message) (interface{}, error) {
+	data, err := q.bodyData(m)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := q.decodeWith(data, m)
+	if err != nil {
+		return nil, err
+	}
+
+	return q.upcast(msg, m)
+}
+
+// bodyData returns the body of m as the codec left it, before decoding
+func (q *queueSQS) bodyData(m *sqs.Message) ([]byte, error) {
+	body, err := q.rehydrate(m)
+	if err != nil {
+		return nil, err
+	}
 
-		for _, handler := range q.thens[msgID] {
-			handler(msg)
+	data := []byte(body)
+	if encodingAttr, ok := m.MessageAttributes["BodyEncoding"]; ok && aws.StringValue(encodingAttr.StringValue) == "base64" {
+		if data, err = base64.StdEncoding.DecodeString(body); err != nil {
+			return nil, errors.Wrap(err, "decoding base64 body")
 		}
-		delete(q.msgIDerrs, msgID)
-	}()
+	}
 
-	select {
-	case <-releaseWaitErr:
-		log.Info("Processed message from queue")
-		return err
-	case <-time.After(time.Second * time.Duration(timeoutSeconds)):
-		return ErrorDeleteMessageTimeout
+	if data, err = q.decrypt(data, m); err != nil {
+		return nil, err
 	}
+
+	return q.decompress(data, m)
 }
 
 func (q *queueSQS) unmarshal(body string) interface{} {
@@ -97,38 +359,100 @@ func (q *queueSQS) unmarshal(body string) interface{} {
 	return msg.Msg
 }
 
-func (q *queueSQS) resendMessage(m *sqs.Message) error {
+// retry sends m back as a failed attempt
+func (q *queueSQS) retry(m *sqs.Message, msgID string) {
+	q.countRetry(msgID)
+
+	if err := q.resendMessage(m); err != nil {
+		log.Errorf("resending messange to queue: %v", err)
+	}
+}
+
+// delayRetryOf returns the NextDelayRetry of m, 0 if it has none
+func delayRetryOf(m *sqs.Message) (int64, error) {
 	delayRetry := int64(0)
-	messageAttributes := m.MessageAttributes
 
-	if delayRetryAttr, ok := messageAttributes["NextDelayRetry"]; ok && delayRetryAttr.StringValue != nil {
-		if delayRetryAttr.StringValue != nil {
-			delayRetryValue, err := strconv.ParseInt(*delayRetryAttr.StringValue, 10, 64)
-			delayRetry = delayRetryValue
+	if delayRetryAttr, ok := m.MessageAttributes["NextDelayRetry"]; ok && delayRetryAttr.StringValue != nil {
+		delayRetryValue, err := strconv.ParseInt(*delayRetryAttr.StringValue, 10, 64)
+		delayRetry = delayRetryValue
 
-			if err != nil {
-				return errors.Wrap(err, "Incorrect value of NextDelayRetry")
-			}
+		if err != nil {
+			return 0, errors.Wrap(err, "Incorrect value of NextDelayRetry")
 		}
 	}
 
-	method := ""
+	return delayRetry, nil
+}
+
+func (q *queueSQS) resendMessage(m *sqs.Message) error {
+	messageAttributes := m.MessageAttributes
+
+	delayRetry, err := delayRetryOf(m)
+	if err != nil {
+		return err
+	}
+
 	if methodAttr, ok := messageAttributes["Method"]; ok {
-		if methodAttr.StringValue != nil {
-			method = *methodAttr.StringValue
-		} else {
+		if methodAttr.StringValue == nil {
 			return ErrorMethodAttrNil
 		}
 	}
 
-	thenable := q.PutString(method, *m.Body, delayRetry)
-	if thenable.Error != nil {
-		return thenable.Error
+	/*
+		The message is sent back as it came, so any attribute that describes
+		the body (e.g. an offloaded BlobKey) is kept. Only the delay changes.
+	*/
+
+	resendAttributes := map[string]*sqs.MessageAttributeValue{}
+	for name, attr := range messageAttributes {
+		resendAttributes[name] = attr
 	}
+
+	resendAttributes["NextDelayRetry"] = q.nextDelayRetry(delayRetry)
+
+	if _, err := q.send(aws.StringValue(m.Body), delayRetry, resendAttributes); err != nil {
+		return err
+	}
+
 	return nil
 }
 
+// deadLetter takes the message out of the retry loop. It goes to the dead-letter
+// queue if there is one, otherwise it's dropped
+func (q *queueSQS) deadLetter(m *sqs.Message, reason error) {
+	if !q.compensate(m, reason) {
+		q.settle(m, nil, reason)
+	}
+
+	if q.DeadLetterURL == "" {
+		log.Errorf("dropping message: %v", reason)
+
+		if err := q.removeBlob(m); err != nil {
+			log.Errorf("removing offloaded body: %v", err)
+		}
+
+		return
+	}
+
+	deadLetterAttributes := map[string]*sqs.MessageAttributeValue{}
+	for name, attr := range m.MessageAttributes {
+		deadLetterAttributes[name] = attr
+	}
+
+	deadLetterAttributes["DeadLetterReason"] = &sqs.MessageAttributeValue{
+		DataType:    aws.String("String"),
+		StringValue: aws.String(reason.Error()),
+	}
+
+	if _, err := q.sendTo(q.DeadLetterURL, aws.StringValue(m.Body), 0, deadLetterAttributes); err != nil {
+		log.Errorf("sending message to dead-letter queue: %v", err)
+	}
+}
+
 func (q *queueSQS) prepareMessageID(m *sqs.Message) (string, error) {
+	q.msgIDerrsMutex.Lock()
+	defer q.msgIDerrsMutex.Unlock()
+
 	msgID := ""
 	if m.MD5OfBody != nil {
 		msgID = *m.MD5OfBody
@@ -147,3 +471,20 @@ func (q *queueSQS) prepareMessageID(m *sqs.Message) (string, error) {
 
 	return msgID, nil
 }
+
+// countRetry counts a failed attempt of the message msgID. The handlers run
+// in their own goroutines, so the counts are kept under a lock
+func (q *queueSQS) countRetry(msgID string) {
+	q.msgIDerrsMutex.Lock()
+	defer q.msgIDerrsMutex.Unlock()
+
+	q.msgIDerrs[msgID]++
+}
+
+// forgetRetries drops the count of the message msgID, that is done
+func (q *queueSQS) forgetRetries(msgID string) {
+	q.msgIDerrsMutex.Lock()
+	defer q.msgIDerrsMutex.Unlock()
+
+	delete(q.msgIDerrs, msgID)
+}
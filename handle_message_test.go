@@ -70,7 +70,7 @@ func Test_handleMessage_once(t *testing.T) {
 	}
 
 	queue := queueSQS{
-		thens:     map[string][]MessageHandler{},
+		requests:  &requests{},
 		SQS:       session,
 		URL:       "",
 		msgIDerrs: map[string]int{},
@@ -111,7 +111,7 @@ func Test_handleMessage_resend(t *testing.T) {
 	}
 
 	queue := queueSQS{
-		thens:     map[string][]MessageHandler{},
+		requests:  &requests{},
 		SQS:       session,
 		URL:       "",
 		msgIDerrs: map[string]int{},
@@ -150,7 +150,7 @@ func Test_handleMessage_deletion_error(t *testing.T) {
 	}
 
 	queue := queueSQS{
-		thens:     map[string][]MessageHandler{},
+		requests:  &requests{},
 		SQS:       session,
 		URL:       "",
 		msgIDerrs: map[string]int{},
@@ -188,11 +188,13 @@ func Test_handleMessage_deletion_timeout(t *testing.T) {
 	}
 
 	queue := queueSQS{
-		thens:          map[string][]MessageHandler{},
-		SQS:            session,
-		URL:            "",
-		TimeoutSeconds: 1,
-		msgIDerrs:      map[string]int{},
+		queueConfig: queueConfig{
+			TimeoutSeconds: 1,
+		},
+		requests:  &requests{},
+		SQS:       session,
+		URL:       "",
+		msgIDerrs: map[string]int{},
 	}
 
 	msg := sqs.Message{}
@@ -212,11 +214,13 @@ func Test_handleMessage_deletion_timeout(t *testing.T) {
 func Test_resendMessage_OK(t *testing.T) {
 	session := &Mock4handleMessageAWSSession{}
 	queue := queueSQS{
-		thens:                    map[string][]MessageHandler{},
-		SQS:                      session,
-		URL:                      "",
-		TimeoutSeconds:           1,
-		NextDelayIncreaseSeconds: 3,
+		queueConfig: queueConfig{
+			TimeoutSeconds:           1,
+			NextDelayIncreaseSeconds: 3,
+		},
+		requests: &requests{},
+		SQS:      session,
+		URL:      "",
 	}
 
 	currentRetry := int64(10)
@@ -242,11 +246,13 @@ func Test_resendMessage_OK(t *testing.T) {
 func Test_resendMessage_Incorrect_NextDelayRetry(t *testing.T) {
 	session := &Mock4handleMessageAWSSession{}
 	queue := queueSQS{
-		thens:                    map[string][]MessageHandler{},
-		SQS:                      session,
-		URL:                      "",
-		TimeoutSeconds:           1,
-		NextDelayIncreaseSeconds: 3,
+		queueConfig: queueConfig{
+			TimeoutSeconds:           1,
+			NextDelayIncreaseSeconds: 3,
+		},
+		requests: &requests{},
+		SQS:      session,
+		URL:      "",
 	}
 
 	incorrectNumber := "NaN"
@@ -269,11 +275,13 @@ func Test_resendMessage_Incorrect_NextDelayRetry(t *testing.T) {
 func Test_resendMessage_Nil_Method(t *testing.T) {
 	session := &Mock4handleMessageAWSSession{}
 	queue := queueSQS{
-		thens:                    map[string][]MessageHandler{},
-		SQS:                      session,
-		URL:                      "",
-		TimeoutSeconds:           1,
-		NextDelayIncreaseSeconds: 3,
+		queueConfig: queueConfig{
+			TimeoutSeconds:           1,
+			NextDelayIncreaseSeconds: 3,
+		},
+		requests: &requests{},
+		SQS:      session,
+		URL:      "",
 	}
 
 	msg := sqs.Message{}
@@ -314,7 +322,7 @@ func Test_handleMessage_resend_maxNumberOfRetries_reached(t *testing.T) {
 	}
 
 	queue := queueSQS{
-		thens:     map[string][]MessageHandler{},
+		requests:  &requests{},
 		SQS:       session,
 		URL:       "",
 		msgIDerrs: map[string]int{},
@@ -348,7 +356,7 @@ func Test_handleMessage_resend_maxNumberOfRetries_reached(t *testing.T) {
 // This test is for educational purposes
 func Test_unmarshal_complex_thing(t *testing.T) {
 	queue := queueSQS{
-		thens: map[string][]MessageHandler{},
+		requests: &requests{},
 	}
 
 	type complexObject struct {
@@ -487,3 +495,40 @@ func Test_unmarshal_2_several_structures(t *testing.T) {
 	}()
 
 }
+
+/*
+	Case 6: once the max number of retries is reached the message goes to the dead-letter queue
+*/
+func Test_handleMessage_maxNumberOfRetries_dead_letter(t *testing.T) {
+	session := &Mock4handleMessageAWSSession{}
+
+	handler := func(msg interface{}) error {
+		return nil
+	}
+
+	queue := queueSQS{
+		queueConfig: queueConfig{
+			DeadLetterURL: "dead-letter",
+		},
+		requests:  &requests{},
+		SQS:       session,
+		URL:       "",
+		msgIDerrs: map[string]int{"messageID": maxNumberOfRetries},
+	}
+
+	msg := sqs.Message{}
+	msg.Body = aws.String("a message")
+	msg.ReceiptHandle = aws.String("a receipt handle")
+	msg.MD5OfBody = aws.String("messageID")
+	msg.MessageAttributes = map[string]*sqs.MessageAttributeValue{
+		"NextDelayRetry": {
+			DataType:    aws.String("Number"),
+			StringValue: aws.String("10"),
+		},
+	}
+	err := queue.handleMessage(handler, &msg)
+
+	assert.Equal(t, ErrorRequestMaxRetries, err)
+	assert.Equal(t, 1, session.TimesCalledSendMessage)
+	assert.Equal(t, "a message", *session.LastBodySent)
+}
@@ -0,0 +1,184 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const httpTimeoutSecondsDefault = 30
+
+// HTTPRequest is the message of the handler returned by NewHTTPHandler. By
+// default any 2xx status is expected
+type HTTPRequest struct {
+	Method           string            `json:"method"`
+	URL              string            `json:"url"`
+	Headers          map[string]string `json:"headers,omitempty"`
+	Body             string            `json:"body,omitempty"`
+	ExpectedStatuses []int             `json:"expected_statuses,omitempty"`
+	TimeoutSeconds   int               `json:"timeout_seconds,omitempty"`
+}
+
+// HTTPResponse is the result of the handler returned by NewHTTPHandler. A body
+// larger than a message is dropped, and BodyDropped tells so
+type HTTPResponse struct {
+	Status      int               `json:"status"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Body        string            `json:"body,omitempty"`
+	BodyDropped bool              `json:"body_dropped,omitempty"`
+}
+
+// HTTPStatusError is the error of a response with an unexpected status
+type HTTPStatusError struct {
+	Status int
+	Body   string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("unexpected HTTP status %d: %s", e.Status, e.Body)
+}
+
+// NewHTTPHandler returns a handler, to register with RegisterReply, that makes
+// the HTTPRequest of the message and returns its HTTPResponse. A 4xx status is
+// a permanent error, except 408 and 429 that are retried like the 5xx and the
+// timeouts, honouring Retry-After. The request is done once the call succeeds,
+// so a response body larger than a message is dropped rather than failing. Put the request with the Then option to send the response to
+// a follow-up method, so a failure to send it doesn't repeat the request
+func NewHTTPHandler(client *http.Client) ReplyHandler {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return func(msg interface{}) (interface{}, error) {
+		request, err := httpRequestOf(msg)
+		if err != nil {
+			return nil, Permanent(err)
+		}
+
+		return doHTTP(client, request)
+	}
+}
+
+func httpRequestOf(msg interface{}) (*HTTPRequest, error) {
+	data, ok := msg.(string)
+	if !ok {
+		encoded, err := json.Marshal(msg)
+		if err != nil {
+			return nil, errors.Wrap(err, "json marshal error")
+		}
+
+		data = string(encoded)
+	}
+
+	request := HTTPRequest{}
+	if err := json.Unmarshal([]byte(data), &request); err != nil {
+		return nil, errors.Wrap(err, "json unmarshal error")
+	}
+
+	if request.Method == "" {
+		request.Method = http.MethodGet
+	}
+
+	return &request, nil
+}
+
+func doHTTP(client *http.Client, request *HTTPRequest) (*HTTPResponse, error) {
+	timeoutSeconds := request.TimeoutSeconds
+	if timeoutSeconds == 0 {
+		timeoutSeconds = httpTimeoutSecondsDefault
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutSeconds)*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequest(request.Method, request.URL, strings.NewReader(request.Body))
+	if err != nil {
+		return nil, Permanent(errors.Wrap(err, "building HTTP request"))
+	}
+
+	for name, value := range request.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "HTTP request error")
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxMessageSizeBytes+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading HTTP response")
+	}
+
+	response := &HTTPResponse{
+		Status:  resp.StatusCode,
+		Headers: map[string]string{},
+		Body:    string(body),
+	}
+
+	if len(body) > maxMessageSizeBytes {
+		response.Body = ""
+		response.BodyDropped = true
+	}
+
+	for name := range resp.Header {
+		response.Headers[name] = resp.Header.Get(name)
+	}
+
+	if expectedStatus(request, resp.StatusCode) {
+		return response, nil
+	}
+
+	statusErr := &HTTPStatusError{Status: resp.StatusCode, Body: response.Body}
+
+	switch {
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		if after, ok := retryAfterHeader(resp.Header.Get("Retry-After")); ok {
+			return nil, RetryAfter(statusErr, after)
+		}
+
+		return nil, statusErr
+	}
+
+	return nil, Permanent(statusErr)
+}
+
+func expectedStatus(request *HTTPRequest, status int) bool {
+	if len(request.ExpectedStatuses) == 0 {
+		return status >= 200 && status < 300
+	}
+
+	for _, expected := range request.ExpectedStatuses {
+		if status == expected {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retryAfterHeader reads a Retry-After header, either in seconds or a date
+func retryAfterHeader(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if at, err := http.ParseTime(value); err == nil {
+		return time.Until(at), true
+	}
+
+	return 0, false
+}
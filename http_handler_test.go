@@ -0,0 +1,164 @@
+package queue
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+	Case 1: the response of the request is the result, and goes on to the method of Then
+*/
+func Test_HTTPHandler_ok(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		assert.Equal(t, `{"amount":10}`, string(body))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"id":"charge-1"}`))
+	}))
+	defer server.Close()
+
+	handler := NewHTTPHandler(server.Client())
+	request := map[string]interface{}{
+		"method":  "POST",
+		"url":     server.URL + "/charges",
+		"headers": map[string]interface{}{"Authorization": "Bearer token"},
+		"body":    `{"amount":10}`,
+	}
+
+	result, err := handler(request)
+	assert.Nil(t, err)
+
+	response := result.(*HTTPResponse)
+	assert.Equal(t, http.StatusCreated, response.Status)
+	assert.Equal(t, `{"id":"charge-1"}`, response.Body)
+	assert.Equal(t, "application/json", response.Headers["Content-Type"])
+
+	session := &Mock4EncryptAWSSession{sent: make(chan *sqs.SendMessageInput, 1)}
+	queue := NewSQSQueue(session, "requests").(*queueSQS)
+
+	assert.Nil(t, queue.PutJSON("http.call", request, 0, Then("charge.created")).Error)
+	assert.Nil(t, queue.handleReply(handler, receivedMessage(<-session.sent)))
+
+	followUp := receivedMessage(<-session.sent)
+	assert.Equal(t, "charge.created", *followUp.MessageAttributes["Method"].StringValue)
+	assert.Contains(t, *followUp.Body, `"status":201`)
+}
+
+func statusServer(status int, retryAfter string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+
+		w.WriteHeader(status)
+	}))
+}
+
+/*
+	Case 2: a 4xx is permanent, a 5xx or 429 is retried honouring Retry-After
+*/
+func Test_HTTPHandler_statuses(t *testing.T) {
+	handler := NewHTTPHandler(nil)
+
+	server := statusServer(http.StatusBadRequest, "")
+	_, err := handler(HTTPRequest{URL: server.URL})
+	server.Close()
+
+	assert.True(t, IsPermanent(err))
+	assert.Equal(t, http.StatusBadRequest, errors.Cause(err).(*HTTPStatusError).Status)
+
+	server = statusServer(http.StatusServiceUnavailable, "")
+	_, err = handler(HTTPRequest{URL: server.URL})
+	server.Close()
+
+	assert.False(t, IsPermanent(err))
+	_, ok := retryAfter(err)
+	assert.False(t, ok)
+
+	server = statusServer(http.StatusTooManyRequests, "7")
+	_, err = handler(HTTPRequest{URL: server.URL})
+	server.Close()
+
+	assert.False(t, IsPermanent(err))
+	after, ok := retryAfter(err)
+	assert.True(t, ok)
+	assert.Equal(t, 7*time.Second, after)
+
+	/*
+		The expected statuses may be others than 2xx
+	*/
+	server = statusServer(http.StatusNotFound, "")
+	result, err := handler(HTTPRequest{URL: server.URL, ExpectedStatuses: []int{http.StatusNotFound}})
+	server.Close()
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNotFound, result.(*HTTPResponse).Status)
+}
+
+/*
+	Case 3: a timeout is retried, a malformed request isn't
+*/
+func Test_HTTPHandler_errors(t *testing.T) {
+	unblock := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer server.Close()
+
+	handler := NewHTTPHandler(nil)
+
+	_, err := handler(HTTPRequest{URL: server.URL, TimeoutSeconds: 1})
+	close(unblock)
+
+	assert.NotNil(t, err)
+	assert.False(t, IsPermanent(err))
+
+	_, err = handler(HTTPRequest{Method: "BAD METHOD", URL: server.URL})
+	assert.True(t, IsPermanent(err))
+
+	_, err = handler("not a request")
+	assert.True(t, IsPermanent(err))
+}
+
+/*
+	Case 4: Retry-After may be a date
+*/
+func Test_retryAfterHeader(t *testing.T) {
+	after, ok := retryAfterHeader(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	assert.True(t, ok)
+	assert.InDelta(t, time.Minute, after, float64(2*time.Second))
+
+	_, ok = retryAfterHeader("soon")
+	assert.False(t, ok)
+}
+
+/*
+	Case 5: the body of a response larger than a message is dropped, the call succeeded
+*/
+func Test_HTTPHandler_response_too_large(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(strings.Repeat("a", maxMessageSizeBytes+1)))
+	}))
+	defer server.Close()
+
+	result, err := NewHTTPHandler(nil)(HTTPRequest{URL: server.URL})
+	assert.Nil(t, err)
+
+	response := result.(*HTTPResponse)
+	assert.Equal(t, http.StatusOK, response.Status)
+	assert.Equal(t, "", response.Body)
+	assert.True(t, response.BodyDropped)
+}
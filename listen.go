@@ -11,38 +11,57 @@ import (
 
 // listen - A worker loop that reads and processes queue messages.
 func (q *queueSQS) listen() error {
+	log.Info("Starting the listen process")
+
+	for {
+		messages, err := q.receive(waitTimeSeconds)
+		if err != nil {
+			return err
+		}
+
+		for _, msg := range messages {
+			if err := q.dispatch(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// receive reads the next messages, waiting up to waitSeconds for them
+func (q *queueSQS) receive(waitSeconds int64) ([]*sqs.Message, error) {
 	params := sqs.ReceiveMessageInput{
 		QueueUrl:            aws.String(q.URL),
 		MaxNumberOfMessages: aws.Int64(maxNumberOfMessages),
 		MessageAttributeNames: []*string{
 			aws.String("All"), // Required
 		},
-		WaitTimeSeconds:   aws.Int64(waitTimeSeconds),
+		WaitTimeSeconds:   aws.Int64(waitSeconds),
 		VisibilityTimeout: aws.Int64(waitTimeSeconds), // (1) check footnote
 	}
 
-	log.Info("Starting the listen process")
+	resp, err := q.SQS.ReceiveMessage(&params)
+	if err != nil {
+		return nil, errors.Wrap(err, "SQS.ReceiveMessage error")
+	}
 
-	for {
-		resp, err := q.SQS.ReceiveMessage(&params)
+	return resp.Messages, nil
+}
 
-		if err != nil {
-			return errors.Wrap(err, "SQS.ReceiveMessage error")
-		}
+// dispatch sends msg to its handler
+func (q *queueSQS) dispatch(msg *sqs.Message) error {
+	unwrapSNS(msg)
+	unpackMeta(msg)
 
-		if len(resp.Messages) > 0 {
-			for _, msg := range resp.Messages {
-				handler, err := q.matchHandler(msg)
-				if err != nil {
-					return err
-				}
+	handler, err := q.matchReplyHandler(msg)
+	if err != nil {
+		return err
+	}
 
-				if err := q.handleMessage(handler, msg); err != nil {
-					return errors.Wrap(err, "handling queue message")
-				}
-			}
-		}
+	if err := q.handleReply(handler, msg); err != nil {
+		return errors.Wrap(err, "handling queue message")
 	}
+
+	return nil
 }
 
 func (q *queueSQS) matchHandler(msg *sqs.Message) (MessageHandler, error) {
@@ -53,7 +72,7 @@ func (q *queueSQS) matchHandler(msg *sqs.Message) (MessageHandler, error) {
 		methodName = *methodNameAttr.StringValue
 	}
 
-	if handler, ok := q.handlerMap[methodName]; ok {
+	if handler, ok := q.handlerMap[q.patternFor(methodName)]; ok {
 		return handler, nil
 	}
 
@@ -56,9 +56,11 @@ func Test_listen_calls_ReceiveMessage(t *testing.T) {
 	}
 
 	queue := queueSQS{
-		thens:      map[string][]MessageHandler{},
-		SQS:        session,
-		handlerMap: map[string]MessageHandler{},
+		queueConfig: queueConfig{
+			handlerMap: map[string]MessageHandler{},
+		},
+		requests: &requests{},
+		SQS:      session,
 	}
 
 	queue.Register("", handler)
@@ -107,10 +109,12 @@ func Test_listen_calls_ReceiveMessage_with_two_responses(t *testing.T) {
 	}
 
 	queue := queueSQS{
-		thens:      map[string][]MessageHandler{},
-		SQS:        session,
-		handlerMap: map[string]MessageHandler{},
-		msgIDerrs:  map[string]int{},
+		queueConfig: queueConfig{
+			handlerMap: map[string]MessageHandler{},
+		},
+		requests:  &requests{},
+		SQS:       session,
+		msgIDerrs: map[string]int{},
 	}
 
 	queue.Register("", handler)
@@ -138,9 +142,11 @@ func Test_listen_calls_ReceiveMessage_error_listen_error_too(t *testing.T) {
 	session.Waiter.Add(1)
 
 	queue := queueSQS{
-		thens:      map[string][]MessageHandler{},
-		SQS:        session,
-		handlerMap: map[string]MessageHandler{},
+		queueConfig: queueConfig{
+			handlerMap: map[string]MessageHandler{},
+		},
+		requests: &requests{},
+		SQS:      session,
 	}
 
 	err := queue.listen()
@@ -155,8 +161,10 @@ func Test_listen_calls_ReceiveMessage_error_listen_error_too(t *testing.T) {
 */
 func Test_matchHandler_not_found(t *testing.T) {
 	queue := queueSQS{
-		thens:      map[string][]MessageHandler{},
-		handlerMap: map[string]MessageHandler{},
+		queueConfig: queueConfig{
+			handlerMap: map[string]MessageHandler{},
+		},
+		requests: &requests{},
 	}
 
 	msg := &sqs.Message{}
@@ -179,10 +187,12 @@ func Test_matchHandler_match_named_handler(t *testing.T) {
 	}
 
 	queue := queueSQS{
-		thens: map[string][]MessageHandler{},
-		handlerMap: map[string]MessageHandler{
-			method: namedHandler,
+		queueConfig: queueConfig{
+			handlerMap: map[string]MessageHandler{
+				method: namedHandler,
+			},
 		},
+		requests: &requests{},
 	}
 
 	msg := &sqs.Message{}
@@ -218,8 +228,8 @@ func Test_listen_matchHandler_err(t *testing.T) {
 	session.Waiter.Add(1)
 
 	queue := queueSQS{
-		thens: map[string][]MessageHandler{},
-		SQS:   session,
+		requests: &requests{},
+		SQS:      session,
 	}
 
 	err := queue.listen()
@@ -241,8 +251,8 @@ func Test_listen_handleMessage_err(t *testing.T) {
 	session.Waiter.Add(1)
 
 	queue := queueSQS{
-		thens: map[string][]MessageHandler{},
-		SQS:   session,
+		requests: &requests{},
+		SQS:      session,
 	}
 	queue.Register("", func(msg interface{}) error {
 		return nil
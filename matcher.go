@@ -0,0 +1,124 @@
+package queue
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// methodMatcher finds the pattern that matches a method name. An exact name wins
+// over a prefix like billing.*, the longest prefix wins over the shorter ones,
+// and a prefix wins over any other wildcard like *.v2 or *
+type methodMatcher struct {
+	exact     map[string]bool
+	prefixes  []string
+	wildcards []string
+}
+
+func isPattern(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+// prefixOf returns the prefix of a pattern like billing.*, if it is one
+func prefixOf(pattern string) (string, bool) {
+	prefix := strings.TrimSuffix(pattern, "*")
+	if prefix == pattern || prefix == "" || isPattern(prefix) {
+		return "", false
+	}
+
+	return prefix, true
+}
+
+func (mm *methodMatcher) add(pattern string) {
+	mm.remove(pattern)
+
+	if !isPattern(pattern) {
+		if mm.exact == nil {
+			mm.exact = map[string]bool{}
+		}
+
+		mm.exact[pattern] = true
+
+		return
+	}
+
+	if _, ok := prefixOf(pattern); ok {
+		mm.prefixes = append(mm.prefixes, pattern)
+		sort.Slice(mm.prefixes, func(i, j int) bool {
+			if len(mm.prefixes[i]) != len(mm.prefixes[j]) {
+				return len(mm.prefixes[i]) > len(mm.prefixes[j])
+			}
+
+			return mm.prefixes[i] < mm.prefixes[j]
+		})
+
+		return
+	}
+
+	mm.wildcards = append(mm.wildcards, pattern)
+	sort.Slice(mm.wildcards, func(i, j int) bool {
+		return mm.less(mm.wildcards[i], mm.wildcards[j])
+	})
+}
+
+// less orders the wildcards, the more literal characters the more specific
+func (mm *methodMatcher) less(a, b string) bool {
+	literalA := len(a) - strings.Count(a, "*") - strings.Count(a, "?")
+	literalB := len(b) - strings.Count(b, "*") - strings.Count(b, "?")
+
+	if literalA != literalB {
+		return literalA > literalB
+	}
+
+	return a < b
+}
+
+func (mm *methodMatcher) remove(pattern string) {
+	delete(mm.exact, pattern)
+	mm.prefixes = without(mm.prefixes, pattern)
+	mm.wildcards = without(mm.wildcards, pattern)
+}
+
+func without(patterns []string, pattern string) []string {
+	kept := patterns[:0]
+	for _, p := range patterns {
+		if p != pattern {
+			kept = append(kept, p)
+		}
+	}
+
+	return kept
+}
+
+// match returns the pattern that matches method
+func (mm *methodMatcher) match(method string) (string, bool) {
+	if mm.exact[method] {
+		return method, true
+	}
+
+	for _, pattern := range mm.prefixes {
+		if prefix, _ := prefixOf(pattern); strings.HasPrefix(method, prefix) {
+			return pattern, true
+		}
+	}
+
+	for _, pattern := range mm.wildcards {
+		if ok, err := path.Match(pattern, method); err == nil && ok {
+			return pattern, true
+		}
+	}
+
+	return "", false
+}
+
+// patterns returns all the patterns, in the order they are tried
+func (mm *methodMatcher) patterns() []string {
+	exact := make([]string, 0, len(mm.exact))
+	for pattern := range mm.exact {
+		exact = append(exact, pattern)
+	}
+
+	sort.Strings(exact)
+
+	return append(append(exact, mm.prefixes...), mm.wildcards...)
+}
@@ -0,0 +1,53 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+	Case 1: exact > longest prefix > wildcard
+*/
+func Test_methodMatcher_precedence(t *testing.T) {
+	mm := methodMatcher{}
+	for _, pattern := range []string{"*", "*.v2", "billing.*", "billing.charge.*", "billing.charge", "billing.*.v2"} {
+		mm.add(pattern)
+	}
+
+	cases := map[string]string{
+		"billing.charge":         "billing.charge",
+		"billing.charge.retry":   "billing.charge.*",
+		"billing.refund":         "billing.*",
+		"billing.refund.v2":      "billing.*",
+		"customers.create.v2":    "*.v2",
+		"customers.create":       "*",
+		"billing.charge.refund2": "billing.charge.*",
+	}
+
+	for method, expected := range cases {
+		pattern, ok := mm.match(method)
+		assert.True(t, ok, method)
+		assert.Equal(t, expected, pattern, method)
+	}
+
+	assert.Equal(t, []string{"billing.charge", "billing.charge.*", "billing.*", "billing.*.v2", "*.v2", "*"}, mm.patterns())
+}
+
+/*
+	Case 2: without a catch-all some methods match nothing, and patterns can be replaced
+*/
+func Test_methodMatcher_no_match(t *testing.T) {
+	mm := methodMatcher{}
+	mm.add("billing.*")
+	mm.add("billing.*")
+
+	_, ok := mm.match("customers.create")
+	assert.False(t, ok)
+	assert.Equal(t, []string{"billing.*"}, mm.patterns())
+
+	mm.remove("billing.*")
+
+	_, ok = mm.match("billing.charge")
+	assert.False(t, ok)
+}
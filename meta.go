@@ -0,0 +1,113 @@
+package queue
+
+import (
+	"encoding/json"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/pkg/errors"
+
+	// nolint: depguard
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	metaAttributeName    = "x-meta"
+	maxMessageAttributes = 10
+)
+
+// metaAttributes are the attributes the library sets on its own. SQS and SNS
+// take up to 10 attributes per message, so these travel packed into the x-meta
+// attribute. Method and NextDelayRetry stay apart, as the listeners that don't
+// know about x-meta read them, and so the attributes of the caller
+var metaAttributes = map[string]bool{
+	"RequestID":        true,
+	"ReplyTo":          true,
+	"ReplyError":       true,
+	"ReplyExpires":     true,
+	"Then":             true,
+	"Group":            true,
+	"Saga":             true,
+	"IdempotencyKey":   true,
+	"DeliverAt":        true,
+	"ContentType":      true,
+	"SchemaVersion":    true,
+	"ContentEncoding":  true,
+	"KeyID":            true,
+	"EncryptedDataKey": true,
+	"BodyEncoding":     true,
+	"BlobKey":          true,
+}
+
+// packMeta returns the attributes to send, with the ones of the library packed
+func packMeta(messageAttributes map[string]*sqs.MessageAttributeValue) (map[string]*sqs.MessageAttributeValue, error) {
+	packed := map[string]*sqs.MessageAttributeValue{}
+	meta := map[string]string{}
+
+	for name, attr := range messageAttributes {
+		if attr == nil {
+			continue
+		}
+
+		if metaAttributes[name] {
+			meta[name] = aws.StringValue(attr.StringValue)
+			continue
+		}
+
+		packed[name] = attr
+	}
+
+	if len(meta) > 0 {
+		value, _ := json.Marshal(meta) // a map of strings always marshals
+		packed[metaAttributeName] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(string(value)),
+		}
+	}
+
+	if len(packed) > maxMessageAttributes {
+		return nil, ErrorTooManyAttributes
+	}
+
+	return packed, nil
+}
+
+// unpackMeta restores the attributes of the library packed into x-meta. A bad
+// x-meta is logged and dropped, the message goes on without those attributes
+func unpackMeta(m *sqs.Message) {
+	metaAttr, ok := m.MessageAttributes[metaAttributeName]
+	if !ok {
+		return
+	}
+
+	/*
+		The attributes may be shared with whoever received the message, so
+		they are copied rather than changed in place
+	*/
+
+	messageAttributes := map[string]*sqs.MessageAttributeValue{}
+	for name, attr := range m.MessageAttributes {
+		if name != metaAttributeName {
+			messageAttributes[name] = attr
+		}
+	}
+
+	m.MessageAttributes = messageAttributes
+
+	if metaAttr == nil {
+		return
+	}
+
+	meta := map[string]string{}
+	if err := json.Unmarshal([]byte(aws.StringValue(metaAttr.StringValue)), &meta); err != nil {
+		log.Errorf("unpacking attributes: %v", errors.Wrap(err, "Incorrect value of x-meta"))
+		return
+	}
+
+	for name, value := range meta {
+		messageAttributes[name] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(value),
+		}
+	}
+}
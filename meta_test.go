@@ -0,0 +1,119 @@
+package queue
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+)
+
+// checkAttributes fails like SQS and SNS do with more than 10 attributes
+func checkAttributes(count int) error {
+	if count > maxMessageAttributes {
+		return ErrorTooManyAttributes
+	}
+
+	return nil
+}
+
+// attributesOf returns the attributes of a sent message, the packed ones unpacked
+func attributesOf(input *sqs.SendMessageInput) map[string]*sqs.MessageAttributeValue {
+	return receivedMessage(input).MessageAttributes
+}
+
+// attributeOf returns the value of the attribute name of a sent message
+func attributeOf(input *sqs.SendMessageInput, name string) string {
+	if attr, ok := attributesOf(input)[name]; ok {
+		return aws.StringValue(attr.StringValue)
+	}
+
+	return ""
+}
+
+/*
+	Case 1: the attributes of the library travel in one attribute
+*/
+func Test_packMeta(t *testing.T) {
+	session := &MockAWSSessionThen{}
+	queue := NewSQSQueue(session, "requests",
+		WithEncryption(NewStaticKeyProvider(map[string][]byte{"key-1": testKey1}), "key-1"),
+		WithCompression(EncodingGzip),
+	)
+
+	thenable := queue.PutJSON("billing.charge", "a charge", 0,
+		IdempotencyKey("charge-1"), Then("billing.receipt"), withReplyTo("replies"), func(messageAttributes map[string]*sqs.MessageAttributeValue) {
+			messageAttributes["Tenant"] = &sqs.MessageAttributeValue{
+				DataType:    aws.String("String"),
+				StringValue: aws.String("acme"),
+			}
+		})
+	assert.Nil(t, thenable.Error)
+
+	assert.Equal(t, 4, len(session.input.MessageAttributes))
+	assert.Equal(t, "billing.charge", *session.input.MessageAttributes["Method"].StringValue)
+	assert.Equal(t, "acme", *session.input.MessageAttributes["Tenant"].StringValue)
+	assert.Contains(t, session.input.MessageAttributes, "NextDelayRetry")
+
+	meta := map[string]string{}
+	assert.Nil(t, json.Unmarshal([]byte(*session.input.MessageAttributes[metaAttributeName].StringValue), &meta))
+	assert.Equal(t, "charge-1", meta["IdempotencyKey"])
+	assert.Equal(t, "key-1", meta["KeyID"])
+	assert.Equal(t, "replies", meta["ReplyTo"])
+
+	m := receivedMessage(session.input)
+	assert.Equal(t, thenable.requestID, requestID(m))
+	assert.NotContains(t, m.MessageAttributes, metaAttributeName)
+
+	msg, err := queue.(*queueSQS).decode(m)
+	assert.Nil(t, err)
+	assert.Equal(t, "a charge", msg)
+}
+
+/*
+	Case 2: a message with more than 10 attributes is refused before it's sent
+*/
+func Test_packMeta_too_many_attributes(t *testing.T) {
+	session := &MockAWSSessionThen{}
+	queue := NewSQSQueue(session, "requests")
+
+	tags := func(names string) PutOption {
+		return func(messageAttributes map[string]*sqs.MessageAttributeValue) {
+			for _, name := range strings.Split(names, " ") {
+				messageAttributes[name] = &sqs.MessageAttributeValue{
+					DataType:    aws.String("String"),
+					StringValue: aws.String(name),
+				}
+			}
+		}
+	}
+
+	/*
+		Method, NextDelayRetry and x-meta leave 7 attributes to the caller
+	*/
+
+	assert.Equal(t, ErrorTooManyAttributes, queue.PutJSON("method", "a message", 0, tags("a b c d e f g h")).Error)
+	assert.Nil(t, session.input)
+
+	assert.Nil(t, queue.PutJSON("method", "a message", 0, tags("a b c d e f g"), IdempotencyKey("key"), Then("next")).Error)
+	assert.Equal(t, 10, len(session.input.MessageAttributes))
+}
+
+/*
+	Case 3: a bad x-meta is dropped
+*/
+func Test_unpackMeta_incorrect(t *testing.T) {
+	m := &sqs.Message{
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			metaAttributeName: {
+				DataType:    aws.String("String"),
+				StringValue: aws.String("not a JSON"),
+			},
+		},
+	}
+
+	unpackMeta(m)
+	assert.Empty(t, m.MessageAttributes)
+}
@@ -0,0 +1,207 @@
+package queue
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+
+	// nolint: depguard
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	outboxBatchSize       = 100
+	outboxLeaseSeconds    = 60
+	outboxIntervalSeconds = 1
+)
+
+// Outbox keeps the messages in a table, written in the same transaction as the
+// rows they talk about, until the relay sends them to the queue. The table must
+// have the columns
+//
+//	id            INTEGER PRIMARY KEY, auto increment
+//	method        VARCHAR(255) NOT NULL
+//	body          TEXT NOT NULL
+//	delay_seconds INTEGER NOT NULL DEFAULT 0
+//	attempts      INTEGER NOT NULL DEFAULT 0
+//	last_error    TEXT
+//	claimed_until TIMESTAMP
+//	published_at  TIMESTAMP
+//
+// The queries use ? placeholders, as MySQL and SQLite do
+type Outbox struct {
+	DB          *sql.DB
+	Table       string
+	Queue       SQSQueue
+	MaxAttempts int
+	Lease       time.Duration
+}
+
+// NewOutbox returns the outbox kept in table, relayed to queue
+func NewOutbox(db *sql.DB, table string, queue SQSQueue) *Outbox {
+	return &Outbox{
+		DB:          db,
+		Table:       table,
+		Queue:       queue,
+		MaxAttempts: maxNumberOfRetries,
+		Lease:       outboxLeaseSeconds * time.Second,
+	}
+}
+
+// PutString writes an string for method in tx. It's sent once tx is committed
+// and the relay runs
+func (o *Outbox) PutString(tx *sql.Tx, method, msg string, delaySeconds int64) error {
+	query := "INSERT INTO " + o.Table + " (method, body, delay_seconds, attempts) VALUES (?, ?, ?, 0)"
+	if _, err := tx.Exec(query, method, msg, delaySeconds); err != nil {
+		return errors.Wrap(err, "SQL insert error")
+	}
+
+	return nil
+}
+
+// PutJSON writes a JSON for method in tx, the handler receives it as PutJSON sends it
+func (o *Outbox) PutJSON(tx *sql.Tx, method string, msg interface{}, delaySeconds int64) error {
+	body, err := json.Marshal(msgJSON{Msg: msg})
+	if err != nil {
+		return errors.Wrap(err, "json marshal error")
+	}
+
+	return o.PutString(tx, method, string(body), delaySeconds)
+}
+
+type outboxRecord struct {
+	id           int64
+	method       string
+	body         string
+	delaySeconds int64
+}
+
+// Relay sends the pending records and returns how many were sent. Each record
+// is claimed before it's sent, so two relays don't send it at the same time,
+// and marked as published once. A record that fails is retried by the next
+// relays until MaxAttempts
+func (o *Outbox) Relay() (int, error) {
+	records, err := o.pending()
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+
+	for _, record := range records {
+		claimed, err := o.claim(record.id)
+		if err != nil {
+			return sent, err
+		}
+
+		if !claimed {
+			continue
+		}
+
+		/*
+			The body goes as it was written, PutJSON already wrapped it. If the
+			process stops between the send and the mark, the record is sent
+			again once the lease expires. The key lets the listener skip it
+		*/
+
+		key := fmt.Sprintf("%s:%d", o.Table, record.id)
+		thenable := o.Queue.PutString(record.method, record.body, record.delaySeconds, IdempotencyKey(key))
+
+		if thenable.Error != nil {
+			log.Errorf("relaying outbox record %d: %v", record.id, thenable.Error)
+
+			if err := o.release(record.id, thenable.Error); err != nil {
+				return sent, err
+			}
+
+			continue
+		}
+
+		if err := o.markPublished(record.id); err != nil {
+			return sent, err
+		}
+
+		sent++
+	}
+
+	return sent, nil
+}
+
+// Run relays the outbox every interval, forever
+func (o *Outbox) Run(interval time.Duration) {
+	if interval <= 0 {
+		interval = outboxIntervalSeconds * time.Second
+	}
+
+	for {
+		if _, err := o.Relay(); err != nil {
+			log.Errorf("relaying outbox: %v", err)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+func (o *Outbox) pending() ([]outboxRecord, error) {
+	query := "SELECT id, method, body, delay_seconds FROM " + o.Table +
+		" WHERE published_at IS NULL AND attempts < ? AND (claimed_until IS NULL OR claimed_until < ?)" +
+		" ORDER BY id LIMIT ?"
+
+	rows, err := o.DB.Query(query, o.MaxAttempts, time.Now().UTC(), outboxBatchSize)
+	if err != nil {
+		return nil, errors.Wrap(err, "SQL select error")
+	}
+	defer rows.Close()
+
+	records := []outboxRecord{}
+
+	for rows.Next() {
+		record := outboxRecord{}
+		if err := rows.Scan(&record.id, &record.method, &record.body, &record.delaySeconds); err != nil {
+			return nil, errors.Wrap(err, "SQL scan error")
+		}
+
+		records = append(records, record)
+	}
+
+	return records, errors.Wrap(rows.Err(), "SQL select error")
+}
+
+func (o *Outbox) claim(id int64) (bool, error) {
+	now := time.Now().UTC()
+	query := "UPDATE " + o.Table + " SET claimed_until = ?" +
+		" WHERE id = ? AND published_at IS NULL AND (claimed_until IS NULL OR claimed_until < ?)"
+
+	result, err := o.DB.Exec(query, now.Add(o.Lease), id, now)
+	if err != nil {
+		return false, errors.Wrap(err, "SQL update error")
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "SQL update error")
+	}
+
+	return n == 1, nil
+}
+
+func (o *Outbox) release(id int64, reason error) error {
+	query := "UPDATE " + o.Table + " SET claimed_until = NULL, attempts = attempts + 1, last_error = ? WHERE id = ?"
+	if _, err := o.DB.Exec(query, reason.Error(), id); err != nil {
+		return errors.Wrap(err, "SQL update error")
+	}
+
+	return nil
+}
+
+func (o *Outbox) markPublished(id int64) error {
+	query := "UPDATE " + o.Table + " SET published_at = ?, claimed_until = NULL WHERE id = ? AND published_at IS NULL"
+	if _, err := o.DB.Exec(query, time.Now().UTC(), id); err != nil {
+		return errors.Wrap(err, "SQL update error")
+	}
+
+	return nil
+}
@@ -0,0 +1,168 @@
+package queue
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+)
+
+func openOutbox(t *testing.T, queue SQSQueue) *Outbox {
+	db, err := sql.Open("sqlite3", ":memory:")
+	assert.Nil(t, err)
+
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`CREATE TABLE outbox (
+		id            INTEGER PRIMARY KEY AUTOINCREMENT,
+		method        VARCHAR(255) NOT NULL,
+		body          TEXT NOT NULL,
+		delay_seconds INTEGER NOT NULL DEFAULT 0,
+		attempts      INTEGER NOT NULL DEFAULT 0,
+		last_error    TEXT,
+		claimed_until TIMESTAMP,
+		published_at  TIMESTAMP
+	)`)
+	assert.Nil(t, err)
+
+	return NewOutbox(db, "outbox", queue)
+}
+
+func writeOutbox(t *testing.T, outbox *Outbox, commit bool, method string, msg interface{}) {
+	tx, err := outbox.DB.Begin()
+	assert.Nil(t, err)
+
+	assert.Nil(t, outbox.PutJSON(tx, method, msg, 0))
+
+	if commit {
+		assert.Nil(t, tx.Commit())
+	} else {
+		assert.Nil(t, tx.Rollback())
+	}
+}
+
+/*
+	Case 1: only the committed records are sent, once
+*/
+func Test_Outbox_Relay(t *testing.T) {
+	s := &MockAWSSessionThen{}
+	outbox := openOutbox(t, NewSQSQueue(s, "requests"))
+	defer outbox.DB.Close()
+
+	writeOutbox(t, outbox, false, "method", "rolled back")
+	writeOutbox(t, outbox, true, "method", "committed")
+
+	sent, err := outbox.Relay()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, sent)
+	assert.Equal(t, `{"msg":"committed"}`, *s.input.MessageBody)
+	assert.Equal(t, "outbox:1", attributeOf(s.input, "IdempotencyKey"))
+
+	sent, err = outbox.Relay()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, sent)
+}
+
+/*
+	Case 2: a record that fails is retried, up to MaxAttempts
+*/
+func Test_Outbox_Relay_retries(t *testing.T) {
+	s := &MockAWSSessionThen{SendMessageError: errors.New("intentional error")}
+	outbox := openOutbox(t, NewSQSQueue(s, "requests"))
+	defer outbox.DB.Close()
+
+	outbox.MaxAttempts = 2
+	writeOutbox(t, outbox, true, "method", "a message")
+
+	sent, err := outbox.Relay()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, sent)
+
+	lastError := ""
+	assert.Nil(t, outbox.DB.QueryRow("SELECT last_error FROM outbox").Scan(&lastError))
+	assert.Equal(t, "intentional error", lastError)
+
+	s.SendMessageError = nil
+
+	sent, err = outbox.Relay()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, sent)
+}
+
+/*
+	Case 3: the record that reached MaxAttempts stays in the outbox
+*/
+func Test_Outbox_Relay_max_attempts(t *testing.T) {
+	s := &MockAWSSessionThen{SendMessageError: errors.New("intentional error")}
+	outbox := openOutbox(t, NewSQSQueue(s, "requests"))
+	defer outbox.DB.Close()
+
+	outbox.MaxAttempts = 2
+	writeOutbox(t, outbox, true, "method", "a message")
+
+	for i := 0; i < 3; i++ {
+		sent, err := outbox.Relay()
+		assert.Nil(t, err)
+		assert.Equal(t, 0, sent)
+	}
+
+	attempts := 0
+	assert.Nil(t, outbox.DB.QueryRow("SELECT attempts FROM outbox WHERE id = 1").Scan(&attempts))
+	assert.Equal(t, 2, attempts)
+}
+
+/*
+	Case 4: a record claimed by another relay is skipped
+*/
+func Test_Outbox_claim(t *testing.T) {
+	outbox := openOutbox(t, NewSQSQueue(&MockAWSSessionThen{}, "requests"))
+	defer outbox.DB.Close()
+
+	writeOutbox(t, outbox, true, "method", "a message")
+
+	claimed, err := outbox.claim(1)
+	assert.Nil(t, err)
+	assert.True(t, claimed)
+
+	sent, err := outbox.Relay()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, sent)
+}
+
+/*
+	Case 5: the records go through PutString as they were written, with the attributes of the queue
+*/
+func Test_Outbox_Relay_uses_PutString(t *testing.T) {
+	s := &Mock4EncryptAWSSession{sent: make(chan *sqs.SendMessageInput, 2)}
+	queue := NewSQSQueue(s, "requests", WithCompression(EncodingGzip))
+	outbox := openOutbox(t, queue)
+	defer outbox.DB.Close()
+
+	writeOutbox(t, outbox, true, "method", map[string]interface{}{"id": uint64(12345678901234567890), "a": 1})
+
+	tx, err := outbox.DB.Begin()
+	assert.Nil(t, err)
+	assert.Nil(t, outbox.PutString(tx, "method", "a string", 0))
+	assert.Nil(t, tx.Commit())
+
+	sent, err := outbox.Relay()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, sent)
+
+	first := <-s.sent
+	assert.Equal(t, EncodingGzip, attributeOf(first, "ContentEncoding"))
+
+	data, err := queue.(*queueSQS).bodyData(receivedMessage(first))
+	assert.Nil(t, err)
+	assert.Equal(t, `{"msg":{"a":1,"id":12345678901234567890}}`, string(data))
+
+	msg, err := queue.(*queueSQS).decode(receivedMessage(first))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"a": float64(1), "id": float64(12345678901234567890)}, msg)
+
+	msg, err = queue.(*queueSQS).decode(receivedMessage(<-s.sent))
+	assert.Nil(t, err)
+	assert.Equal(t, "a string", msg)
+}
@@ -1,34 +1,79 @@
 package queue
 
 import (
-	"encoding/json"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/sqs"
-	"github.com/pkg/errors"
 
 	// nolint: depguard
 	log "github.com/sirupsen/logrus"
 )
 
 // PutString sends an string to the queue
-func (q *queueSQS) PutString(method, msg string, delaySeconds int64) *sqsResponseThenable {
+func (q *queueSQS) PutString(method, msg string, delaySeconds int64, opts ...PutOption) *sqsResponseThenable {
+	return q.put(method, msg, []byte(msg), delaySeconds, map[string]*sqs.MessageAttributeValue{}, opts)
+}
+
+// put sends data, that is msg already encoded, to the queue. messageAttributes
+// may come with the ones set by the codec
+func (q *queueSQS) put(method string, msg interface{}, data []byte, delaySeconds int64, messageAttributes map[string]*sqs.MessageAttributeValue, opts []PutOption) *sqsResponseThenable {
 	thenable := &sqsResponseThenable{
 		queue: q,
+		msg:   msg,
 	}
 
-	if q.NextDelayIncreaseSeconds == 0 {
-		q.NextDelayIncreaseSeconds = nextDelayIncreaseSecondsDefault
+	for _, opt := range opts {
+		opt(messageAttributes)
 	}
 
-	nextDelay := delaySeconds + q.NextDelayIncreaseSeconds
-	messageAttributes := map[string]*sqs.MessageAttributeValue{
-		"NextDelayRetry": {
-			DataType:    aws.String("Number"),
-			StringValue: aws.String(fmt.Sprintf("%d", nextDelay)),
-		},
+	_, expectsReply := messageAttributes[expectReplyAttr]
+	delete(messageAttributes, expectReplyAttr)
+
+	fail := func(err error) *sqsResponseThenable {
+		q.repliesMutex.Lock()
+		delete(q.replies, thenable.requestID)
+		q.repliesMutex.Unlock()
+
+		thenable.Error = err
+		thenable.settle(err)
+
+		return thenable
+	}
+
+	/*
+		The next steps of a chain keep the RequestID of the first message
+	*/
+
+	if idAttr, ok := messageAttributes["RequestID"]; ok {
+		thenable.requestID = aws.StringValue(idAttr.StringValue)
+	} else {
+		thenable.requestID = newID()
+		withRequestID(thenable.requestID)(messageAttributes)
+
+		if expectsReply {
+			waiter, err := q.expectReply(thenable.requestID, messageAttributes)
+			if err != nil {
+				return fail(err)
+			}
+
+			thenable.reply = waiter
+		}
+	}
+
+	/*
+		A scheduled message retries as soon as it's due, not after its delay
+	*/
+
+	if _, ok := messageAttributes["DeliverAt"]; ok {
+		messageAttributes["NextDelayRetry"] = q.nextDelayRetry(0)
+	} else {
+		messageAttributes["NextDelayRetry"] = q.nextDelayRetry(delaySeconds)
 	}
 
 	if method != "" {
@@ -38,47 +83,198 @@ func (q *queueSQS) PutString(method, msg string, delaySeconds int64) *sqsRespons
 		}
 	}
 
-	params := sqs.SendMessageInput{
-		QueueUrl:          aws.String(q.URL),
-		MessageBody:       aws.String(msg),
-		DelaySeconds:      aws.Int64(delaySeconds),
-		MessageAttributes: messageAttributes,
+	q.stampSchemaVersion(method, messageAttributes)
+
+	body, err := q.encodeBody(data, messageAttributes)
+	if err != nil {
+		return fail(err)
 	}
 
-	response, err := q.SQS.SendMessage(&params)
+	response, err := q.send(body, delaySeconds, messageAttributes)
 	if err != nil {
-		thenable.Error = err
-		return thenable
+		return fail(err)
 	}
 
 	thenable.messageID = aws.StringValue(response.MessageId)
-	q.thens[thenable.messageID] = []MessageHandler{}
 
 	return thenable
 }
 
-// PutString sends a JSON to the queue
-func (q *queueSQS) PutJSON(method string, msg interface{}, delaySeconds int64) *sqsResponseThenable {
-	thenable := &sqsResponseThenable{}
-	msgBytes, err := json.Marshal(msgJSON{
-		Msg: msg,
-	})
+// encodeBody turns msg into the body that travels in the message, the attributes
+// record every step so the listener can revert them
+func (q *queueSQS) encodeBody(data []byte, messageAttributes map[string]*sqs.MessageAttributeValue) (string, error) {
+	data, err := q.compress(data, messageAttributes)
+	if err != nil {
+		return "", err
+	}
+
+	if data, err = q.encrypt(data, messageAttributes); err != nil {
+		return "", err
+	}
 
+	body := string(data)
+	if !isMessageText(data) {
+		body = base64.StdEncoding.EncodeToString(data)
+		messageAttributes["BodyEncoding"] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String("base64"),
+		}
+	}
+
+	return q.offload(body, messageAttributes)
+}
+
+// isMessageText reports whether data contains only the characters allowed in a SQS message body
+func isMessageText(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+
+	for _, r := range string(data) {
+		switch {
+		case r == 0x9 || r == 0xA || r == 0xD:
+		case r >= 0x20 && r <= 0xD7FF:
+		case r >= 0xE000 && r <= 0xFFFD:
+		case r >= 0x10000 && r <= 0x10FFFF:
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// send puts the already prepared body and attributes into the queue
+func (q *queueSQS) send(body string, delaySeconds int64, messageAttributes map[string]*sqs.MessageAttributeValue) (*sqs.SendMessageOutput, error) {
+	return q.sendTo(q.URL, body, delaySeconds, messageAttributes)
+}
+
+// sendTo puts the already prepared body and attributes into the queue at url
+func (q *queueSQS) sendTo(url, body string, delaySeconds int64, messageAttributes map[string]*sqs.MessageAttributeValue) (*sqs.SendMessageOutput, error) {
+	params := sqs.SendMessageInput{
+		QueueUrl:     aws.String(url),
+		MessageBody:  aws.String(body),
+		DelaySeconds: aws.Int64(delaySeconds),
+	}
+
+	messageAttributes, err := withFIFO(&params, messageAttributes)
+	if err != nil {
+		return nil, err
+	}
+
+	messageAttributes, err = packMeta(messageAttributes)
 	if err != nil {
-		thenable.Error = errors.Wrap(err, "PutJSON error")
+		return nil, err
+	}
+
+	params.MessageAttributes = messageAttributes
+
+	return q.SQS.SendMessage(&params)
+}
+
+// nextDelayRetry returns the NextDelayRetry attribute for a message sent with delaySeconds
+func (q *queueSQS) nextDelayRetry(delaySeconds int64) *sqs.MessageAttributeValue {
+	increase := q.NextDelayIncreaseSeconds
+	if increase == 0 {
+		increase = nextDelayIncreaseSecondsDefault
+	}
+
+	return &sqs.MessageAttributeValue{
+		DataType:    aws.String("Number"),
+		StringValue: aws.String(fmt.Sprintf("%d", delaySeconds+increase)),
+	}
+}
+
+// PutJSON sends a JSON to the queue
+func (q *queueSQS) PutJSON(method string, msg interface{}, delaySeconds int64, opts ...PutOption) *sqsResponseThenable {
+	return q.putWith(jsonCodec{}, method, msg, delaySeconds, opts)
+}
+
+// Put sends msg to the queue encoded with the codec of method, JSON by default
+func (q *queueSQS) Put(method string, msg interface{}, delaySeconds int64, opts ...PutOption) *sqsResponseThenable {
+	return q.putWith(q.codecFor(method), method, msg, delaySeconds, opts)
+}
+
+func (q *queueSQS) putWith(codec Codec, method string, msg interface{}, delaySeconds int64, opts []PutOption) *sqsResponseThenable {
+	messageAttributes := map[string]*sqs.MessageAttributeValue{}
+
+	data, err := q.marshal(codec, msg, messageAttributes)
+	if err != nil {
+		thenable := &sqsResponseThenable{
+			queue: q,
+			msg:   msg,
+			Error: err,
+		}
+		thenable.settle(err)
+
 		return thenable
 	}
 
-	return q.PutString(method, string(msgBytes), delaySeconds)
+	return q.put(method, msg, data, delaySeconds, messageAttributes, opts)
 }
 
-// Register method
-func (q *queueSQS) Register(name string, method MessageHandler) {
+// Register method. The name may be a pattern: a prefix like billing.* or a
+// wildcard like *.v2. A name wins over a prefix, the longest prefix wins over
+// the shorter ones, and a prefix wins over any other wildcard
+func (q *queueSQS) Register(name string, method MessageHandler, opts ...HandlerOption) {
 	if q.handlerMap == nil {
 		q.handlerMap = map[string]MessageHandler{}
 	}
 
 	q.handlerMap[name] = method
+
+	if q.handlerConfigs == nil {
+		q.handlerConfigs = map[string]*handlerConfig{}
+	}
+
+	q.handlerConfigs[name] = q.configure(name, opts)
+}
+
+// configure returns the options of the registered method name, that may be a
+// pattern. Register and RegisterReply keep them apart, as a name may have both
+func (q *queueSQS) configure(name string, opts []HandlerOption) *handlerConfig {
+	if q.handlers == nil {
+		q.handlers = &methodMatcher{}
+	}
+
+	q.handlers.add(name)
+
+	config := &handlerConfig{}
+	for _, opt := range opts {
+		opt(config)
+	}
+
+	return config
+}
+
+// configFor returns the options of the handler of m
+func (q *queueSQS) configFor(m *sqs.Message) *handlerConfig {
+	if config, ok := q.configNamed(q.patternFor(methodOf(m))); ok {
+		return config
+	}
+
+	return &handlerConfig{}
+}
+
+// configNamed returns the options of the handler registered as name. As with
+// matchReplyHandler, the one of RegisterReply wins over the one of Register
+func (q *queueSQS) configNamed(name string) (*handlerConfig, bool) {
+	if _, ok := q.replyHandlerMap[name]; ok {
+		config, ok := q.replyHandlerConfigs[name]
+		return config, ok
+	}
+
+	config, ok := q.handlerConfigs[name]
+
+	return config, ok
+}
+
+func methodOf(m *sqs.Message) string {
+	if methodAttr, ok := m.MessageAttributes["Method"]; ok && methodAttr != nil {
+		return aws.StringValue(methodAttr.StringValue)
+	}
+
+	return ""
 }
 
 // Listen method
@@ -92,16 +288,55 @@ func (q *queueSQS) Listen() {
 	}
 }
 
+// WithBlobStore offloads the bodies that don't fit into a SQS message to store
+func WithBlobStore(store BlobStore) Option {
+	return func(q *queueSQS) {
+		q.Blobs = store
+	}
+}
+
+// WithOffloadThreshold sets the message size from which the body is offloaded
+func WithOffloadThreshold(bytes int) Option {
+	return func(q *queueSQS) {
+		q.OffloadThresholdBytes = bytes
+	}
+}
+
+// WithDeadLetterQueue sends to url the messages that can't be processed anymore
+func WithDeadLetterQueue(url string) Option {
+	return func(q *queueSQS) {
+		q.DeadLetterURL = url
+	}
+}
+
+// newID returns a random identifier
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
+
 // NewSQSQueue jajaja
-func NewSQSQueue(sqssession iSQSSession, url string) SQSQueue {
+func NewSQSQueue(sqssession iSQSSession, url string, opts ...Option) SQSQueue {
 	queue := queueSQS{
-		SQS:                      sqssession,
-		URL:                      url,
-		TimeoutSeconds:           timeoutSecondsDefault,
-		NextDelayIncreaseSeconds: nextDelayIncreaseSecondsDefault,
-		handlerMap:               map[string]MessageHandler{},
-		msgIDerrs:                map[string]int{},
-		thens:                    map[string][]MessageHandler{},
+		queueConfig: queueConfig{
+			TimeoutSeconds:           timeoutSecondsDefault,
+			NextDelayIncreaseSeconds: nextDelayIncreaseSecondsDefault,
+			handlerMap:               map[string]MessageHandler{},
+		},
+		requests: &requests{
+			thens: map[string][]MessageHandler{},
+		},
+		SQS:       sqssession,
+		URL:       url,
+		msgIDerrs: map[string]int{},
+	}
+
+	for _, opt := range opts {
+		opt(&queue)
 	}
 
 	return &queue
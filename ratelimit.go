@@ -0,0 +1,177 @@
+package queue
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+// RateLimiter tells if a message for method may be handled now. If not, it
+// returns how long to wait for the next token
+type RateLimiter interface {
+	Allow(method string) (bool, time.Duration, error)
+}
+
+// WithRateLimit defers the messages of the method while limiter doesn't allow
+// them. A deferred message is sent back with the wait as delay, and it doesn't
+// count as a retry
+func WithRateLimit(limiter RateLimiter) HandlerOption {
+	return func(config *handlerConfig) {
+		config.rateLimiter = limiter
+	}
+}
+
+// throttle defers m if its method is over the limit, and tells if it did
+func (q *queueSQS) throttle(m *sqs.Message) (bool, error) {
+	limiter := q.configFor(m).rateLimiter
+	if limiter == nil {
+		return false, nil
+	}
+
+	allowed, wait, err := limiter.Allow(methodOf(m))
+	if err != nil || allowed {
+		return false, err
+	}
+
+	return true, q.requeue(m, waitSeconds(wait))
+}
+
+// waitSeconds turns wait into a delay SQS accepts, at least a second
+func waitSeconds(wait time.Duration) int64 {
+	delaySeconds := int64(math.Ceil(wait.Seconds()))
+
+	switch {
+	case delaySeconds < 1:
+		return 1
+	case delaySeconds > maxDelaySeconds:
+		return maxDelaySeconds
+	}
+
+	return delaySeconds
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+type memoryTokenBucket struct {
+	Rate    float64
+	Burst   int
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+}
+
+// NewTokenBucket returns a RateLimiter for a single process that allows rate
+// messages per second, and up to burst at once. Both must be positive
+func NewTokenBucket(rate float64, burst int) (RateLimiter, error) {
+	if err := validateRate(rate, burst); err != nil {
+		return nil, err
+	}
+
+	return &memoryTokenBucket{
+		Rate:    rate,
+		Burst:   burst,
+		buckets: map[string]*bucket{},
+	}, nil
+}
+
+func validateRate(rate float64, burst int) error {
+	if rate <= 0 || math.IsNaN(rate) || math.IsInf(rate, 0) || burst < 1 {
+		return ErrorRateLimitInvalid
+	}
+
+	return nil
+}
+
+func (l *memoryTokenBucket) Allow(method string) (bool, time.Duration, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+
+	b, ok := l.buckets[method]
+	if !ok {
+		b = &bucket{
+			tokens:  float64(l.Burst),
+			updated: now,
+		}
+		l.buckets[method] = b
+	}
+
+	b.tokens = math.Min(float64(l.Burst), b.tokens+now.Sub(b.updated).Seconds()*l.Rate)
+	b.updated = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0, nil
+	}
+
+	return false, time.Duration((1 - b.tokens) / l.Rate * float64(time.Second)), nil
+}
+
+/*
+	The script takes a token from the bucket KEYS[1] and returns 0, or the
+	milliseconds to wait for the next one. ARGV[1] is the rate per second,
+	ARGV[2] the burst and ARGV[3] the current time in milliseconds
+*/
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "updated")
+local tokens = tonumber(bucket[1]) or burst
+local updated = tonumber(bucket[2]) or now
+
+tokens = math.min(burst, tokens + math.max(0, now - updated) * rate / 1000)
+
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	wait = math.ceil((1 - tokens) * 1000 / rate)
+end
+
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "updated", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst * 1000 / rate) + 1000)
+
+return wait
+`)
+
+type redisTokenBucket struct {
+	Redis redis.UniversalClient
+	Rate  float64
+	Burst int
+}
+
+// NewRedisTokenBucket returns a RateLimiter shared by every process connected
+// to the same Redis, so the limit holds for all the listeners together. Both
+// rate and burst must be positive
+func NewRedisTokenBucket(client redis.UniversalClient, rate float64, burst int) (RateLimiter, error) {
+	if err := validateRate(rate, burst); err != nil {
+		return nil, err
+	}
+
+	return &redisTokenBucket{
+		Redis: client,
+		Rate:  rate,
+		Burst: burst,
+	}, nil
+}
+
+func (l *redisTokenBucket) Allow(method string) (bool, time.Duration, error) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	wait, err := tokenBucketScript.Run(context.Background(), l.Redis, []string{"sqs-rate:" + method}, l.Rate, l.Burst, now).Int64()
+	if err != nil {
+		return false, 0, errors.Wrap(err, "Redis token bucket script error")
+	}
+
+	return wait == 0, time.Duration(wait) * time.Millisecond, nil
+}
@@ -0,0 +1,178 @@
+package queue
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+	Case 1: a message over the limit is deferred, without counting as a retry
+*/
+func Test_handleMessage_rate_limited(t *testing.T) {
+	session := &Mock4EncryptAWSSession{sent: make(chan *sqs.SendMessageInput, 1)}
+	queue := NewSQSQueue(session, "requests").(*queueSQS)
+
+	handled := make(chan interface{}, 2)
+	handler := func(msg interface{}) error {
+		handled <- msg
+		return nil
+	}
+
+	limiter, err := NewTokenBucket(0.5, 1)
+	assert.Nil(t, err)
+
+	queue.Register("api.call", handler, WithRateLimit(limiter))
+
+	assert.Nil(t, queue.PutJSON("api.call", "first", 0).Error)
+	first := <-session.sent
+	assert.Nil(t, queue.handleMessage(handler, receivedMessage(first)))
+	assert.Equal(t, "first", <-handled)
+
+	assert.Nil(t, queue.PutJSON("api.call", "second", 0).Error)
+	second := <-session.sent
+	second.MessageAttributes["NextDelayRetry"].StringValue = aws.String("3")
+	assert.Nil(t, queue.handleMessage(handler, receivedMessage(second)))
+
+	deferred := <-session.sent
+	assert.Equal(t, int64(2), *deferred.DelaySeconds)
+	assert.Equal(t, *second.MessageBody, *deferred.MessageBody)
+	assert.Equal(t, "3", *deferred.MessageAttributes["NextDelayRetry"].StringValue)
+	assert.Equal(t, 0, len(handled))
+}
+
+/*
+	Case 2: the methods without a limit aren't deferred
+*/
+func Test_handleMessage_not_rate_limited(t *testing.T) {
+	session := &Mock4EncryptAWSSession{sent: make(chan *sqs.SendMessageInput, 1)}
+	queue := NewSQSQueue(session, "requests").(*queueSQS)
+
+	handled := make(chan interface{}, 2)
+	handler := func(msg interface{}) error {
+		handled <- msg
+		return nil
+	}
+
+	limiter, err := NewTokenBucket(0.5, 1)
+	assert.Nil(t, err)
+
+	queue.Register("api.call", handler, WithRateLimit(limiter))
+	queue.Register("other", handler)
+
+	for _, msg := range []string{"first", "second"} {
+		assert.Nil(t, queue.PutJSON("other", msg, 0).Error)
+		assert.Nil(t, queue.handleMessage(handler, receivedMessage(<-session.sent)))
+		assert.Equal(t, msg, <-handled)
+	}
+}
+
+func testRateLimiter(t *testing.T, limiter RateLimiter) {
+	for i := 0; i < 2; i++ {
+		allowed, _, err := limiter.Allow("api.call")
+		assert.Nil(t, err)
+		assert.True(t, allowed)
+	}
+
+	allowed, wait, err := limiter.Allow("api.call")
+	assert.Nil(t, err)
+	assert.False(t, allowed)
+	assert.True(t, wait > 0 && wait <= 100*time.Millisecond, wait)
+
+	/*
+		Each method has its own bucket
+	*/
+	allowed, _, err = limiter.Allow("other")
+	assert.Nil(t, err)
+	assert.True(t, allowed)
+
+	time.Sleep(150 * time.Millisecond)
+
+	allowed, _, err = limiter.Allow("api.call")
+	assert.Nil(t, err)
+	assert.True(t, allowed)
+}
+
+func Test_memoryTokenBucket(t *testing.T) {
+	limiter, err := NewTokenBucket(10, 2)
+	assert.Nil(t, err)
+
+	testRateLimiter(t, limiter)
+}
+
+func Test_redisTokenBucket(t *testing.T) {
+	server, err := miniredis.Run()
+	assert.Nil(t, err)
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+
+	limiter, err := NewRedisTokenBucket(client, 10, 2)
+	assert.Nil(t, err)
+
+	testRateLimiter(t, limiter)
+}
+
+/*
+	Case 3: the rate and the burst must be positive
+*/
+func Test_TokenBucket_invalid(t *testing.T) {
+	for _, limit := range []struct {
+		rate  float64
+		burst int
+	}{{0, 1}, {-1, 1}, {1, 0}, {math.Inf(1), 1}} {
+		_, err := NewTokenBucket(limit.rate, limit.burst)
+		assert.Equal(t, ErrorRateLimitInvalid, err, limit)
+
+		_, err = NewRedisTokenBucket(nil, limit.rate, limit.burst)
+		assert.Equal(t, ErrorRateLimitInvalid, err, limit)
+	}
+}
+
+/*
+	Case 4: a message deferred by an open circuit doesn't spend a token
+*/
+func Test_handleMessage_breaker_before_rate_limit(t *testing.T) {
+	session := &Mock4EncryptAWSSession{sent: make(chan *sqs.SendMessageInput, 1)}
+	queue := NewSQSQueue(session, "requests").(*queueSQS)
+
+	limiter, err := NewTokenBucket(0.5, 1)
+	assert.Nil(t, err)
+
+	handler := func(msg interface{}) error {
+		return nil
+	}
+
+	queue.Register("api.call", handler, WithRateLimit(limiter), WithCircuitBreaker(1, time.Minute))
+	config, _ := queue.configNamed("api.call")
+	config.breaker.record(false)
+
+	assert.Nil(t, queue.PutJSON("api.call", "a message", 0).Error)
+	assert.Nil(t, queue.handleMessage(handler, receivedMessage(<-session.sent)))
+	<-session.sent
+
+	allowed, _, err := limiter.Allow("api.call")
+	assert.Nil(t, err)
+	assert.True(t, allowed)
+}
+
+/*
+	Case 5: a name registered by Register and RegisterReply keeps the options of each
+*/
+func Test_configure_per_handler_map(t *testing.T) {
+	queue := NewSQSQueue(&MockAWSSessionThen{}, "requests").(*queueSQS)
+
+	queue.Register("api.call", func(msg interface{}) error { return nil }, WithMaxConcurrency(1))
+	queue.RegisterReply("api.call", func(msg interface{}) (interface{}, error) { return nil, nil }, WithMaxConcurrency(3))
+
+	assert.Equal(t, 1, cap(queue.handlerConfigs["api.call"].inFlight))
+	assert.Equal(t, 3, cap(queue.replyHandlerConfigs["api.call"].inFlight))
+	assert.Equal(t, 3, cap(queue.configFor(messageFor("api.call")).inFlight))
+}
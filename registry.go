@@ -0,0 +1,62 @@
+package queue
+
+// HandlerRoute is an entry of the routing table of the listener
+type HandlerRoute struct {
+	Pattern string
+	Kind    string
+	Reply   bool
+}
+
+// These are the kinds of HandlerRoute
+const (
+	RouteExact    = "exact"
+	RoutePrefix   = "prefix"
+	RouteWildcard = "wildcard"
+)
+
+// patternFor returns the registered name, or pattern, that handles method
+func (q *queueSQS) patternFor(method string) string {
+	if pattern, ok := q.Resolve(method); ok {
+		return pattern
+	}
+
+	return method
+}
+
+// Resolve returns the registered name, or pattern, whose handler gets the messages of method
+func (q *queueSQS) Resolve(method string) (string, bool) {
+	if q.handlers == nil {
+		return "", false
+	}
+
+	return q.handlers.match(method)
+}
+
+// RoutingTable returns the registered names and patterns in the order they
+// are tried, so the first one that matches a method handles it
+func (q *queueSQS) RoutingTable() []HandlerRoute {
+	routes := []HandlerRoute{}
+	if q.handlers == nil {
+		return routes
+	}
+
+	for _, pattern := range q.handlers.patterns() {
+		kind := RouteWildcard
+
+		if !isPattern(pattern) {
+			kind = RouteExact
+		} else if _, ok := prefixOf(pattern); ok {
+			kind = RoutePrefix
+		}
+
+		_, reply := q.replyHandlerMap[pattern]
+
+		routes = append(routes, HandlerRoute{
+			Pattern: pattern,
+			Kind:    kind,
+			Reply:   reply,
+		})
+	}
+
+	return routes
+}
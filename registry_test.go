@@ -0,0 +1,139 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+)
+
+func messageFor(method string) *sqs.Message {
+	return &sqs.Message{
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			"Method": {
+				DataType:    aws.String("String"),
+				StringValue: aws.String(method),
+			},
+		},
+	}
+}
+
+/*
+	Case 1: the handler of the most specific pattern gets the message
+*/
+func Test_Register_patterns(t *testing.T) {
+	queue := NewSQSQueue(&Mock4ReplyAWSSession{}, "requests").(*queueSQS)
+
+	handled := ""
+	handlerOf := func(pattern string) MessageHandler {
+		return func(msg interface{}) error {
+			handled = pattern
+			return nil
+		}
+	}
+
+	queue.Register("*", handlerOf("*"))
+	queue.Register("*.v2", handlerOf("*.v2"))
+	queue.Register("billing.*", handlerOf("billing.*"))
+	queue.Register("billing.charge", handlerOf("billing.charge"))
+	queue.RegisterReply("billing.refund.*", func(msg interface{}) (interface{}, error) {
+		handled = "billing.refund.*"
+		return nil, nil
+	})
+
+	cases := map[string]string{
+		"billing.charge":         "billing.charge",
+		"billing.invoice":        "billing.*",
+		"billing.refund.partial": "billing.refund.*",
+		"customers.create.v2":    "*.v2",
+		"customers.create":       "*",
+	}
+
+	for method, expected := range cases {
+		handler, err := queue.matchReplyHandler(messageFor(method))
+		assert.Nil(t, err, method)
+
+		_, err = handler("a message")
+		assert.Nil(t, err, method)
+		assert.Equal(t, expected, handled, method)
+
+		pattern, ok := queue.Resolve(method)
+		assert.True(t, ok)
+		assert.Equal(t, expected, pattern)
+	}
+}
+
+/*
+	Case 2: the options of a pattern apply to the methods it matches
+*/
+func Test_Register_pattern_options(t *testing.T) {
+	queue := NewSQSQueue(&Mock4ReplyAWSSession{}, "requests").(*queueSQS)
+
+	queue.Register("billing.*", func(msg interface{}) error {
+		return nil
+	}, WithMaxConcurrency(3))
+
+	assert.Equal(t, 3, cap(queue.configFor(messageFor("billing.charge")).inFlight))
+	assert.Nil(t, queue.configFor(messageFor("customers.create")).inFlight)
+}
+
+/*
+	Case 3: the routing table lists the patterns in the order they are tried
+*/
+func Test_RoutingTable(t *testing.T) {
+	queue := NewSQSQueue(&Mock4ReplyAWSSession{}, "requests")
+
+	handler := func(msg interface{}) error {
+		return nil
+	}
+
+	queue.Register("*", handler)
+	queue.Register("billing.*", handler)
+	queue.RegisterReply("billing.charge", func(msg interface{}) (interface{}, error) {
+		return nil, nil
+	})
+
+	assert.Equal(t, []HandlerRoute{
+		{Pattern: "billing.charge", Kind: RouteExact, Reply: true},
+		{Pattern: "billing.*", Kind: RoutePrefix},
+		{Pattern: "*", Kind: RouteWildcard},
+	}, queue.RoutingTable())
+
+	_, err := queue.(*queueSQS).matchReplyHandler(messageFor("anything"))
+	assert.Nil(t, err)
+}
+
+/*
+	Case 4: a pattern registered by Register and RegisterReply keeps the options of each, the reply handler's apply
+*/
+func Test_Register_pattern_options_per_handler_map(t *testing.T) {
+	queue := NewSQSQueue(&Mock4ReplyAWSSession{}, "requests").(*queueSQS)
+
+	queue.Register("billing.*", func(msg interface{}) error {
+		return nil
+	}, WithMaxConcurrency(1), WithCircuitBreaker(1, time.Minute))
+	queue.RegisterReply("billing.*", func(msg interface{}) (interface{}, error) {
+		return nil, nil
+	}, WithMaxConcurrency(3))
+	queue.RegisterReply("billing.report", func(msg interface{}) (interface{}, error) {
+		return nil, nil
+	})
+
+	assert.Equal(t, 1, cap(queue.handlerConfigs["billing.*"].inFlight))
+	assert.Equal(t, 3, cap(queue.replyHandlerConfigs["billing.*"].inFlight))
+	assert.Equal(t, 3, cap(queue.configFor(messageFor("billing.charge")).inFlight))
+
+	/*
+		The exact name wins over the pattern, with its own options
+	*/
+	assert.Nil(t, queue.configFor(messageFor("billing.report")).inFlight)
+
+	/*
+		The breaker of Register is not the one that applies
+	*/
+	_, ok := queue.Circuit("billing.*")
+	assert.False(t, ok)
+	assert.Empty(t, queue.Circuits())
+}
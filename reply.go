@@ -0,0 +1,402 @@
+package queue
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/pkg/errors"
+
+	// nolint: depguard
+	log "github.com/sirupsen/logrus"
+)
+
+// ReplyHandler is a MessageHandler that returns a result. Use RegisterReply to define the handler
+type ReplyHandler func(msg interface{}) (interface{}, error)
+
+type replyMessage struct {
+	result interface{}
+	err    error
+}
+
+const (
+	expectReplyAttr         = "ExpectReply"
+	replyQueueRetentionMin  = 60
+	replyQueuePrefixDefault = "replies-"
+)
+
+// WithReplyQueue turns on the request/reply mode. The requests put with
+// ExpectReply ask for a reply to url, that is shared by the producers as the
+// replies carry the RequestID. Use Await on the thenable to get the reply
+func WithReplyQueue(url string) Option {
+	return func(q *queueSQS) {
+		q.ReplyURL = url
+	}
+}
+
+// WithTemporaryReplyQueue turns on the request/reply mode with a reply queue of
+// its own, created by admin on the first request that expects a reply and
+// deleted by Close. Its name starts with prefix
+func WithTemporaryReplyQueue(admin iSQSQueueAdmin, prefix string) Option {
+	return func(q *queueSQS) {
+		if prefix == "" {
+			prefix = replyQueuePrefixDefault
+		}
+
+		q.replyAdmin = admin
+		q.replyQueuePrefix = prefix
+	}
+}
+
+// WithReplyTTL sets how long a reply is worth waiting for. Past it, the reply is
+// deleted by the first producer that gets it, even if it isn't its own
+func WithReplyTTL(ttl time.Duration) Option {
+	return func(q *queueSQS) {
+		q.ReplyTTL = ttl
+	}
+}
+
+// ExpectReply asks for a reply to the request, to Await on its thenable
+func ExpectReply() PutOption {
+	return func(messageAttributes map[string]*sqs.MessageAttributeValue) {
+		messageAttributes[expectReplyAttr] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String("true"),
+		}
+	}
+}
+
+// RegisterReply method
+func (q *queueSQS) RegisterReply(name string, method ReplyHandler, opts ...HandlerOption) {
+	if q.replyHandlerMap == nil {
+		q.replyHandlerMap = map[string]ReplyHandler{}
+	}
+
+	q.replyHandlerMap[name] = method
+
+	if q.replyHandlerConfigs == nil {
+		q.replyHandlerConfigs = map[string]*handlerConfig{}
+	}
+
+	q.replyHandlerConfigs[name] = q.configure(name, opts)
+}
+
+// matchReplyHandler finds the handler of msg, registered by either RegisterReply or Register
+func (q *queueSQS) matchReplyHandler(msg *sqs.Message) (ReplyHandler, error) {
+	if methodNameAttr, ok := msg.MessageAttributes["Method"]; ok && methodNameAttr != nil {
+		if handler, ok := q.replyHandlerMap[q.patternFor(aws.StringValue(methodNameAttr.StringValue))]; ok {
+			return handler, nil
+		}
+	}
+
+	handler, err := q.matchHandler(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(msg interface{}) (interface{}, error) {
+		return nil, handler(msg)
+	}, nil
+}
+
+// Await blocks until the reply of the request arrives or ctx is done. The queue
+// must be created WithReplyQueue
+func (st *sqsResponseThenable) Await(ctx context.Context) (interface{}, error) {
+	if st.Error != nil {
+		return nil, st.Error
+	}
+
+	if st.reply == nil {
+		return nil, ErrorReplyNotExpected
+	}
+
+	st.mutex.Lock()
+	received := st.received
+	st.mutex.Unlock()
+
+	if received != nil {
+		return received.result, received.err
+	}
+
+	select {
+	case reply := <-st.reply:
+		st.mutex.Lock()
+		st.received = &reply
+		st.mutex.Unlock()
+
+		return reply.result, reply.err
+	case <-ctx.Done():
+		st.queue.repliesMutex.Lock()
+		delete(st.queue.replies, st.requestID)
+		st.queue.repliesMutex.Unlock()
+
+		return nil, ctx.Err()
+	}
+}
+
+// expectReply asks for a reply to the request id, registers its waiter and
+// starts listening to the reply queue. The waiter gets the reply even if it
+// arrives before Await
+func (q *queueSQS) expectReply(id string, messageAttributes map[string]*sqs.MessageAttributeValue) (chan replyMessage, error) {
+	q.repliesMutex.Lock()
+	defer q.repliesMutex.Unlock()
+
+	if q.ReplyURL == "" && q.replyAdmin != nil {
+		if err := q.createReplyQueue(); err != nil {
+			return nil, err
+		}
+	}
+
+	if q.ReplyURL == "" {
+		return nil, ErrorReplyNotExpected
+	}
+
+	withReplyTo(q.ReplyURL)(messageAttributes)
+	messageAttributes["ReplyExpires"] = &sqs.MessageAttributeValue{
+		DataType:    aws.String("String"),
+		StringValue: aws.String(strconv.FormatInt(time.Now().Add(q.replyTTL()).Unix(), 10)),
+	}
+
+	if q.replies == nil {
+		q.replies = map[string]chan replyMessage{}
+	}
+
+	waiter := make(chan replyMessage, 1)
+	q.replies[id] = waiter
+	q.listenRepliesOnce.Do(func() {
+		q.repliesDone = make(chan struct{})
+		go q.listenReplies(q.ReplyURL, q.repliesDone)
+	})
+
+	return waiter, nil
+}
+
+// createReplyQueue creates the temporary reply queue. It keeps the replies no
+// longer than they are worth waiting for
+func (q *queueSQS) createReplyQueue() error {
+	retention := int64(q.replyTTL() / time.Second)
+	if retention < replyQueueRetentionMin {
+		retention = replyQueueRetentionMin
+	}
+
+	params := sqs.CreateQueueInput{
+		QueueName: aws.String(q.replyQueuePrefix + newID()),
+		Attributes: map[string]*string{
+			sqs.QueueAttributeNameMessageRetentionPeriod: aws.String(strconv.FormatInt(retention, 10)),
+		},
+	}
+
+	resp, err := q.replyAdmin.CreateQueue(&params)
+	if err != nil {
+		return errors.Wrap(err, "creating the reply queue")
+	}
+
+	q.ReplyURL = aws.StringValue(resp.QueueUrl)
+
+	return nil
+}
+
+// Close stops listening to the replies, and deletes the reply queue if it's temporary
+func (q *queueSQS) Close() error {
+	q.repliesMutex.Lock()
+	defer q.repliesMutex.Unlock()
+
+	q.listenRepliesOnce.Do(func() {})
+	if q.repliesDone != nil {
+		close(q.repliesDone)
+		q.repliesDone = nil
+	}
+
+	if q.replyAdmin == nil || q.ReplyURL == "" {
+		return nil
+	}
+
+	params := sqs.DeleteQueueInput{
+		QueueUrl: aws.String(q.ReplyURL),
+	}
+
+	admin := q.replyAdmin
+
+	// a closed queue doesn't expect replies anymore
+	q.ReplyURL = ""
+	q.replyAdmin = nil
+
+	if _, err := admin.DeleteQueue(&params); err != nil {
+		return errors.Wrap(err, "deleting the reply queue")
+	}
+
+	return nil
+}
+
+func (q *queueSQS) replyTTL() time.Duration {
+	if q.ReplyTTL > 0 {
+		return q.ReplyTTL
+	}
+
+	return replyTTLSecondsDefault * time.Second
+}
+
+// reply sends the result of m, or its error, to the reply queue of m
+func (q *queueSQS) reply(m *sqs.Message, result interface{}, reason error) error {
+	url := replyTo(m)
+	if url == "" {
+		return nil
+	}
+
+	messageAttributes := map[string]*sqs.MessageAttributeValue{}
+	withRequestID(requestID(m))(messageAttributes)
+
+	if expiresAttr, ok := m.MessageAttributes["ReplyExpires"]; ok && expiresAttr != nil {
+		messageAttributes["ReplyExpires"] = expiresAttr
+	}
+
+	if reason != nil {
+		messageAttributes["ReplyError"] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(reason.Error()),
+		}
+	}
+
+	data, err := q.marshal(jsonCodec{}, result, messageAttributes)
+	if err != nil {
+		return err
+	}
+
+	body, err := q.encodeBody(data, messageAttributes)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.sendTo(url, body, 0, messageAttributes)
+
+	return err
+}
+
+// listenReplies - A worker loop that hands the replies of url to their waiters, until done.
+func (q *queueSQS) listenReplies(url string, done chan struct{}) {
+	params := sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(url),
+		MaxNumberOfMessages: aws.Int64(maxNumberOfMessages),
+		MessageAttributeNames: []*string{
+			aws.String("All"), // Required
+		},
+		WaitTimeSeconds:   aws.Int64(waitTimeSeconds),
+		VisibilityTimeout: aws.Int64(replyVisibilityTimeoutSeconds), // (1) check footnote
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		resp, err := q.SQS.ReceiveMessage(&params)
+		if err != nil {
+			log.Errorf("SQS.ReceiveMessage error on replies: %v", err)
+			time.Sleep(time.Duration(retrySecondsToListen) * time.Second)
+
+			continue
+		}
+
+		for _, m := range resp.Messages {
+			if err := q.handleReplyMessage(url, m); err != nil {
+				log.Errorf("handling reply: %v", err)
+			}
+		}
+	}
+}
+
+// handleReplyMessage hands m to its waiter. The replies of the other producers
+// are left in the queue, unless nobody waits for them anymore (2)
+func (q *queueSQS) handleReplyMessage(url string, m *sqs.Message) error {
+	unpackMeta(m)
+
+	id := requestID(m)
+
+	q.repliesMutex.Lock()
+	waiter, ok := q.replies[id]
+	delete(q.replies, id)
+	q.repliesMutex.Unlock()
+
+	if !ok && q.replyAdmin == nil && !replyExpired(m) {
+		return nil
+	}
+
+	params := sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(url),
+		ReceiptHandle: m.ReceiptHandle,
+	}
+
+	if _, err := q.SQS.DeleteMessage(&params); err != nil {
+		log.Errorf("deleting reply: %v", err)
+	}
+
+	if !ok {
+		return nil
+	}
+
+	reply := replyMessage{}
+	if reasonAttr, ok := m.MessageAttributes["ReplyError"]; ok && reasonAttr != nil {
+		reply.err = errors.New(aws.StringValue(reasonAttr.StringValue))
+	}
+
+	result, err := q.decode(m)
+	if err != nil {
+		reply.err = err
+	}
+
+	reply.result = result
+	waiter <- reply
+
+	return nil
+}
+
+// withReplyTo keeps the reply queue of a request along the messages of its chain
+func withReplyTo(url string) PutOption {
+	return func(messageAttributes map[string]*sqs.MessageAttributeValue) {
+		if url == "" {
+			return
+		}
+
+		messageAttributes["ReplyTo"] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(url),
+		}
+	}
+}
+
+// replyExpired tells if nobody waits for the reply m anymore. The replies
+// without an expiry, sent by older producers, never expire
+func replyExpired(m *sqs.Message) bool {
+	expiresAttr, ok := m.MessageAttributes["ReplyExpires"]
+	if !ok || expiresAttr == nil {
+		return false
+	}
+
+	expires, err := strconv.ParseInt(aws.StringValue(expiresAttr.StringValue), 10, 64)
+	if err != nil {
+		return true
+	}
+
+	return time.Now().Unix() > expires
+}
+
+func replyTo(m *sqs.Message) string {
+	if urlAttr, ok := m.MessageAttributes["ReplyTo"]; ok && urlAttr != nil {
+		return aws.StringValue(urlAttr.StringValue)
+	}
+
+	return ""
+}
+
+/*
+(1) The reply queue is shared by the producers, so a producer may get the replies
+	of another one. Those are left in the queue and, with a short VisibilityTimeout,
+	they are soon available to the producer that waits for them.
+(2) A reply past its ReplyExpires has no waiter left, its Await gave up, so any
+	producer deletes it. A temporary reply queue has a single producer, which
+	deletes whatever reply it doesn't wait for.
+*/
@@ -0,0 +1,300 @@
+package queue
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+)
+
+// Mock4ReplyAWSSession keeps one list of messages per queue URL
+type Mock4ReplyAWSSession struct {
+	Locker sync.Mutex
+	queues map[string][]*sqs.Message
+}
+
+func (a *Mock4ReplyAWSSession) SendMessage(input *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
+	if err := checkAttributes(len(input.MessageAttributes)); err != nil {
+		return nil, err
+	}
+
+	a.Locker.Lock()
+	defer a.Locker.Unlock()
+
+	sum := md5.Sum([]byte(*input.MessageBody))
+	id := hex.EncodeToString(sum[:])
+
+	if a.queues == nil {
+		a.queues = map[string][]*sqs.Message{}
+	}
+
+	a.queues[*input.QueueUrl] = append(a.queues[*input.QueueUrl], &sqs.Message{
+		Body:              input.MessageBody,
+		MessageAttributes: input.MessageAttributes,
+		MessageId:         aws.String(id),
+		MD5OfBody:         aws.String(id),
+		ReceiptHandle:     aws.String(id),
+	})
+
+	return &sqs.SendMessageOutput{
+		MessageId:        aws.String(id),
+		MD5OfMessageBody: aws.String(id),
+	}, nil
+}
+
+func (a *Mock4ReplyAWSSession) ReceiveMessage(input *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	a.Locker.Lock()
+	messages := a.queues[*input.QueueUrl]
+	delete(a.queues, *input.QueueUrl)
+	a.Locker.Unlock()
+
+	if len(messages) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return &sqs.ReceiveMessageOutput{
+		Messages: messages,
+	}, nil
+}
+
+func (a *Mock4ReplyAWSSession) DeleteMessage(input *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
+	return nil, nil
+}
+
+/*
+	Case 1: the producer awaits the result returned by the handler
+*/
+func Test_Await_reply(t *testing.T) {
+	session := &Mock4ReplyAWSSession{}
+	queue := NewSQSQueue(session, "requests", WithReplyQueue("replies"))
+
+	queue.RegisterReply("sum", func(msg interface{}) (interface{}, error) {
+		numbers := msg.([]interface{})
+		return numbers[0].(float64) + numbers[1].(float64), nil
+	})
+
+	go queue.Listen()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := queue.PutJSON("sum", []int{1, 2}, 0, ExpectReply()).Await(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, float64(3), result)
+}
+
+/*
+	Case 2: the reply of a chain is the result of its last step
+*/
+func Test_Await_reply_end_of_chain(t *testing.T) {
+	session := &Mock4ReplyAWSSession{}
+	queue := NewSQSQueue(session, "requests", WithReplyQueue("replies"))
+
+	queue.RegisterReply("double", func(msg interface{}) (interface{}, error) {
+		return msg.(float64) * 2, nil
+	})
+	queue.Register("log", func(msg interface{}) error {
+		return nil
+	})
+
+	go queue.Listen()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := queue.PutJSON("double", 2, 0, Then("double", "log"), ExpectReply()).Await(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, float64(8), result)
+}
+
+/*
+	Case 3: the producer gets the error once the request fails for good
+*/
+func Test_Await_reply_error(t *testing.T) {
+	session := &Mock4ReplyAWSSession{}
+	queue := NewSQSQueue(session, "requests", WithReplyQueue("replies"))
+
+	queue.RegisterReply("fail", func(msg interface{}) (interface{}, error) {
+		return nil, errors.New("intentional error")
+	})
+
+	go queue.Listen()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := queue.PutJSON("fail", "a message", 0, ExpectReply()).Await(ctx)
+	assert.NotNil(t, err)
+	assert.Equal(t, ErrorRequestMaxRetries.Error(), err.Error())
+}
+
+/*
+	Case 4: Await gives up once the context is done
+*/
+func Test_Await_timeout(t *testing.T) {
+	session := &Mock4ReplyAWSSession{}
+	queue := NewSQSQueue(session, "requests", WithReplyQueue("replies"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := queue.PutJSON("nobody", "a message", 0, ExpectReply()).Await(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+/*
+	Case 5: without a reply queue there is nothing to await
+*/
+func Test_Await_reply_not_expected(t *testing.T) {
+	queue := NewSQSQueue(&Mock4ReplyAWSSession{}, "requests")
+
+	thenable := queue.PutJSON("method", "a message", 0, ExpectReply())
+	assert.Equal(t, ErrorReplyNotExpected, thenable.Error)
+
+	_, err := thenable.Await(context.Background())
+	assert.Equal(t, ErrorReplyNotExpected, err)
+}
+
+/*
+	Case 6: a request put without ExpectReply doesn't register a waiter nor ask for a reply
+*/
+func Test_put_without_ExpectReply(t *testing.T) {
+	session := &Mock4ReplyAWSSession{}
+	queue := NewSQSQueue(session, "requests", WithReplyQueue("replies")).(*queueSQS)
+
+	thenable := queue.PutJSON("method", "a message", 0)
+	assert.Nil(t, thenable.Error)
+	assert.Empty(t, queue.replies)
+
+	m := session.queues["requests"][0]
+	unpackMeta(m)
+	assert.Equal(t, "", replyTo(m))
+	assert.NotContains(t, m.MessageAttributes, expectReplyAttr)
+
+	_, err := thenable.Await(context.Background())
+	assert.Equal(t, ErrorReplyNotExpected, err)
+}
+
+// Mock4ReplyExpiryAWSSession records the deleted replies
+type Mock4ReplyExpiryAWSSession struct {
+	Mock4ReplyAWSSession
+	deleted []string
+}
+
+func (a *Mock4ReplyExpiryAWSSession) DeleteMessage(input *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
+	a.deleted = append(a.deleted, *input.ReceiptHandle)
+	return nil, nil
+}
+
+func (a *Mock4ReplyExpiryAWSSession) CreateQueue(input *sqs.CreateQueueInput) (*sqs.CreateQueueOutput, error) {
+	return &sqs.CreateQueueOutput{QueueUrl: aws.String("https://sqs/" + *input.QueueName)}, nil
+}
+
+func (a *Mock4ReplyExpiryAWSSession) DeleteQueue(input *sqs.DeleteQueueInput) (*sqs.DeleteQueueOutput, error) {
+	a.deleted = append(a.deleted, *input.QueueUrl)
+	return nil, nil
+}
+
+func replyFor(id, handle string, expires time.Time) *sqs.Message {
+	messageAttributes := map[string]*sqs.MessageAttributeValue{}
+	withRequestID(id)(messageAttributes)
+	messageAttributes["ReplyExpires"] = &sqs.MessageAttributeValue{
+		DataType:    aws.String("String"),
+		StringValue: aws.String(strconv.FormatInt(expires.Unix(), 10)),
+	}
+
+	return &sqs.Message{
+		Body:              aws.String(`{"msg":null}`),
+		ReceiptHandle:     aws.String(handle),
+		MessageAttributes: messageAttributes,
+	}
+}
+
+/*
+	Case 7: the replies of other producers are left in the shared queue, unless expired
+*/
+func Test_handleReplyMessage_expired(t *testing.T) {
+	session := &Mock4ReplyExpiryAWSSession{}
+	queue := NewSQSQueue(session, "requests", WithReplyQueue("replies")).(*queueSQS)
+
+	assert.Nil(t, queue.handleReplyMessage("replies", replyFor("another", "pending", time.Now().Add(time.Minute))))
+	assert.Nil(t, queue.handleReplyMessage("replies", replyFor("another", "expired", time.Now().Add(-time.Minute))))
+	assert.Equal(t, []string{"expired"}, session.deleted)
+}
+
+/*
+	Case 8: the temporary reply queue is created on demand, carried by the request and deleted on Close
+*/
+func Test_WithTemporaryReplyQueue(t *testing.T) {
+	session := &Mock4ReplyExpiryAWSSession{}
+	queue := NewSQSQueue(session, "requests", WithTemporaryReplyQueue(session, "replies-"), WithReplyTTL(time.Minute)).(*queueSQS)
+
+	assert.Nil(t, queue.PutJSON("method", "a message", 0).Error)
+	assert.Equal(t, "", queue.ReplyURL)
+
+	thenable := queue.PutJSON("method", "a message", 0, ExpectReply())
+	assert.Nil(t, thenable.Error)
+	assert.Contains(t, queue.ReplyURL, "https://sqs/replies-")
+
+	session.Locker.Lock()
+	m := session.queues["requests"][1]
+	session.Locker.Unlock()
+
+	unpackMeta(m)
+	assert.Equal(t, queue.ReplyURL, replyTo(m))
+	assert.False(t, replyExpired(m))
+
+	url := queue.ReplyURL
+	assert.Nil(t, queue.Close())
+	assert.Equal(t, url, session.deleted[len(session.deleted)-1])
+
+	assert.Equal(t, ErrorReplyNotExpected, queue.PutJSON("method", "a message", 0, ExpectReply()).Error)
+}
+
+/*
+	Case 9: the reply that arrives before Await isn't lost
+*/
+func Test_Await_after_reply(t *testing.T) {
+	session := &Mock4ReplyAWSSession{}
+	queue := NewSQSQueue(session, "requests", WithReplyQueue("replies")).(*queueSQS)
+
+	queue.RegisterReply("echo", func(msg interface{}) (interface{}, error) {
+		return msg, nil
+	})
+
+	go queue.Listen()
+
+	thenable := queue.PutJSON("echo", "a message", 0, ExpectReply())
+	assert.Nil(t, thenable.Error)
+
+	for i := 0; i < 500; i++ {
+		queue.repliesMutex.Lock()
+		_, waiting := queue.replies[thenable.requestID]
+		queue.repliesMutex.Unlock()
+
+		if !waiting {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	result, err := thenable.Await(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "a message", result)
+
+	result, err = thenable.Await(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "a message", result)
+}
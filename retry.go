@@ -0,0 +1,120 @@
+package queue
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/pkg/errors"
+
+	// nolint: depguard
+	log "github.com/sirupsen/logrus"
+)
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Cause() error {
+	return e.err
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+type retryAfterError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryAfterError) Cause() error {
+	return e.err
+}
+
+func (e *retryAfterError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks err as an error that won't go away by retrying, e.g. a
+// validation error. The message goes straight to the dead-letter path
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &permanentError{err: err}
+}
+
+// RetryAfter asks to retry the message once the duration has passed, instead of
+// after NextDelayRetry. E.g. the Retry-After of a third-party
+func RetryAfter(err error, after time.Duration) error {
+	if err == nil {
+		return nil
+	}
+
+	return &retryAfterError{err: err, after: after}
+}
+
+// IsPermanent tells if err, or any error it wraps, was marked by Permanent
+func IsPermanent(err error) bool {
+	var permanent *permanentError
+	return errors.As(err, &permanent)
+}
+
+func retryAfter(err error) (time.Duration, bool) {
+	var after *retryAfterError
+	if errors.As(err, &after) {
+		return after.after, true
+	}
+
+	return 0, false
+}
+
+// retryFailed sends back m, whose handler returned err, or takes it out of the retries if err is permanent
+func (q *queueSQS) retryFailed(m *sqs.Message, msgID string, err error) {
+	if IsPermanent(err) {
+		q.forgetRetries(msgID)
+		q.deadLetter(m, err)
+
+		return
+	}
+
+	after, ok := retryAfter(err)
+	if !ok {
+		q.retry(m, msgID)
+		return
+	}
+
+	delayRetry, err := delayRetryOf(m)
+	if err != nil {
+		log.Errorf("resending messange to queue: %v", err)
+		return
+	}
+
+	q.countRetry(msgID)
+
+	/*
+		As any retry, the copy advances NextDelayRetry. Beyond the SQS delay
+		limit it hops through the queue until it's due, as PutAt does
+	*/
+
+	opts := []PutOption{func(messageAttributes map[string]*sqs.MessageAttributeValue) {
+		messageAttributes["NextDelayRetry"] = q.nextDelayRetry(delayRetry)
+	}}
+
+	if after > maxDelaySeconds*time.Second {
+		opts = append(opts, withDeliverAt(time.Now().Add(after)))
+	}
+
+	if err := q.requeue(m, waitSeconds(after), opts...); err != nil {
+		log.Errorf("resending messange to queue: %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+	Case 1: a permanent error goes straight to the dead-letter queue
+*/
+func Test_handleMessage_permanent_error(t *testing.T) {
+	session := &Mock4EncryptAWSSession{sent: make(chan *sqs.SendMessageInput, 1)}
+	queue := NewSQSQueue(session, "requests", WithDeadLetterQueue("dead-letters")).(*queueSQS)
+
+	handler := func(msg interface{}) error {
+		return Permanent(errors.New("invalid email"))
+	}
+
+	assert.Nil(t, queue.PutJSON("method", "a message", 0).Error)
+	assert.Nil(t, queue.handleMessage(handler, receivedMessage(<-session.sent)))
+
+	deadLetter := <-session.sent
+	assert.Equal(t, "dead-letters", *deadLetter.QueueUrl)
+	assert.Equal(t, "invalid email", *deadLetter.MessageAttributes["DeadLetterReason"].StringValue)
+	assert.Equal(t, 0, len(queue.msgIDerrs))
+}
+
+/*
+	Case 2: a retry-after error is retried after the given duration
+*/
+func Test_handleMessage_retry_after(t *testing.T) {
+	session := &Mock4EncryptAWSSession{sent: make(chan *sqs.SendMessageInput, 1)}
+	queue := NewSQSQueue(session, "requests").(*queueSQS)
+
+	handler := func(msg interface{}) error {
+		return RetryAfter(errors.New("too many requests"), 30*time.Second)
+	}
+
+	assert.Nil(t, queue.PutJSON("method", "a message", 0).Error)
+	assert.Nil(t, queue.handleMessage(handler, receivedMessage(<-session.sent)))
+
+	retried := <-session.sent
+	assert.Equal(t, "requests", *retried.QueueUrl)
+	assert.Equal(t, int64(30), *retried.DelaySeconds)
+	assert.Equal(t, "2", *retried.MessageAttributes["NextDelayRetry"].StringValue)
+	assert.Equal(t, 1, queue.msgIDerrs["messageID"])
+}
+
+/*
+	Case 3: the wrappers are found through other wrappers
+*/
+func Test_error_classification(t *testing.T) {
+	err := errors.Wrap(Permanent(errors.New("invalid email")), "creating customer")
+	assert.True(t, IsPermanent(err))
+	assert.Equal(t, "creating customer: invalid email", err.Error())
+
+	assert.False(t, IsPermanent(errors.New("timeout")))
+	assert.Nil(t, Permanent(nil))
+	assert.Nil(t, RetryAfter(nil, time.Second))
+
+	after, ok := retryAfter(errors.Wrap(RetryAfter(errors.New("busy"), time.Minute), "calling"))
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, after)
+}
+
+/*
+	Case 4: a retry-after beyond the SQS delay limit hops until it's due
+*/
+func Test_handleMessage_retry_after_long(t *testing.T) {
+	session := &Mock4EncryptAWSSession{sent: make(chan *sqs.SendMessageInput, 1)}
+	queue := NewSQSQueue(session, "requests").(*queueSQS)
+
+	handler := func(msg interface{}) error {
+		return RetryAfter(errors.New("quota exceeded"), 2*time.Hour)
+	}
+
+	assert.Nil(t, queue.PutJSON("method", "a message", 0).Error)
+	assert.Nil(t, queue.handleMessage(handler, receivedMessage(<-session.sent)))
+
+	retried := <-session.sent
+	assert.Equal(t, int64(maxDelaySeconds), *retried.DelaySeconds)
+	assert.Equal(t, "2", *retried.MessageAttributes["NextDelayRetry"].StringValue)
+
+	at, err := deliverAt(receivedMessage(retried))
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now().Add(2*time.Hour), at, time.Minute)
+
+	/*
+		The hop keeps the NextDelayRetry of the retry
+	*/
+	hopped, err := queue.hop(receivedMessage(retried))
+	assert.True(t, hopped)
+	assert.Nil(t, err)
+	assert.Equal(t, "2", *(<-session.sent).MessageAttributes["NextDelayRetry"].StringValue)
+}
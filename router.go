@@ -0,0 +1,147 @@
+package queue
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RouterConfig maps method patterns to queue URLs. Default, if any, takes the
+// methods that match no pattern, so it can't be set along with the pattern *
+type RouterConfig struct {
+	Routes  map[string]string `json:"routes"`
+	Default string            `json:"default,omitempty"`
+}
+
+// Router sends each message to the queue of its method
+type Router struct {
+	matcher  methodMatcher
+	routes   map[string]SQSQueue
+	unrouted *queueSQS
+}
+
+// NewRouter returns a router without routes
+func NewRouter() *Router {
+	return &Router{
+		routes: map[string]SQSQueue{},
+		unrouted: &queueSQS{
+			requests: &requests{},
+		},
+	}
+}
+
+// NewRouterFromConfig returns a router with a queue per URL of the config, in
+// JSON. The queues are created with opts
+func NewRouterFromConfig(config []byte, sqssession iSQSSession, opts ...Option) (*Router, error) {
+	routerConfig := RouterConfig{}
+	if err := json.Unmarshal(config, &routerConfig); err != nil {
+		return nil, errors.Wrap(err, "json unmarshal error")
+	}
+
+	if _, ok := routerConfig.Routes["*"]; ok && routerConfig.Default != "" {
+		return nil, ErrorDefaultRouteConflict
+	}
+
+	r := NewRouter()
+	queues := map[string]SQSQueue{}
+
+	route := func(pattern, url string) {
+		if _, ok := queues[url]; !ok {
+			queues[url] = NewSQSQueue(sqssession, url, opts...)
+		}
+
+		r.Route(pattern, queues[url])
+	}
+
+	for pattern, url := range routerConfig.Routes {
+		route(pattern, url)
+	}
+
+	if routerConfig.Default != "" {
+		route("*", routerConfig.Default)
+	}
+
+	return r, nil
+}
+
+// Route sends the methods that match pattern to queue. A pattern is a method
+// name, a prefix like billing.* or a wildcard like *.v2. An exact name wins over
+// a prefix, the longest prefix wins, and a prefix wins over any other wildcard
+func (r *Router) Route(pattern string, queue SQSQueue) {
+	r.matcher.add(pattern)
+	r.routes[pattern] = queue
+}
+
+// QueueFor returns the queue of method
+func (r *Router) QueueFor(method string) (SQSQueue, error) {
+	pattern, ok := r.matcher.match(method)
+	if !ok {
+		return nil, ErrorRouteNotFound
+	}
+
+	return r.routes[pattern], nil
+}
+
+// routeError returns the thenable of a message that can't be routed. It
+// belongs to a queue that sends nothing
+func (r *Router) routeError(msg interface{}, err error) *sqsResponseThenable {
+	thenable := &sqsResponseThenable{
+		queue: r.unrouted,
+		msg:   msg,
+		Error: err,
+	}
+	thenable.settle(err)
+
+	return thenable
+}
+
+// PutString sends an string to the queue of method
+func (r *Router) PutString(method, msg string, delaySeconds int64, opts ...PutOption) *sqsResponseThenable {
+	queue, err := r.QueueFor(method)
+	if err != nil {
+		return r.routeError(msg, err)
+	}
+
+	return queue.PutString(method, msg, delaySeconds, opts...)
+}
+
+// PutJSON sends a JSON to the queue of method
+func (r *Router) PutJSON(method string, msg interface{}, delaySeconds int64, opts ...PutOption) *sqsResponseThenable {
+	queue, err := r.QueueFor(method)
+	if err != nil {
+		return r.routeError(msg, err)
+	}
+
+	return queue.PutJSON(method, msg, delaySeconds, opts...)
+}
+
+// Put sends msg to the queue of method, encoded with the codec of that queue
+func (r *Router) Put(method string, msg interface{}, delaySeconds int64, opts ...PutOption) *sqsResponseThenable {
+	queue, err := r.QueueFor(method)
+	if err != nil {
+		return r.routeError(msg, err)
+	}
+
+	return queue.Put(method, msg, delaySeconds, opts...)
+}
+
+// PutAt sends msg to the queue of method, to be handled at the given time
+func (r *Router) PutAt(method string, msg interface{}, at time.Time, opts ...PutOption) *sqsResponseThenable {
+	queue, err := r.QueueFor(method)
+	if err != nil {
+		return r.routeError(msg, err)
+	}
+
+	return queue.PutAt(method, msg, at, opts...)
+}
+
+// PutAfter sends msg to the queue of method, to be handled once the duration has passed
+func (r *Router) PutAfter(method string, msg interface{}, after time.Duration, opts ...PutOption) *sqsResponseThenable {
+	queue, err := r.QueueFor(method)
+	if err != nil {
+		return r.routeError(msg, err)
+	}
+
+	return queue.PutAfter(method, msg, after, opts...)
+}
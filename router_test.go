@@ -0,0 +1,115 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+	Case 1: each method goes to the queue of its route
+*/
+func Test_Router_Put(t *testing.T) {
+	session := &Mock4ReplyAWSSession{}
+
+	router := NewRouter()
+	router.Route("billing.*", NewSQSQueue(session, "billing"))
+	router.Route("billing.report", NewSQSQueue(session, "reports"))
+	router.Route("*", NewSQSQueue(session, "default"))
+
+	assert.Nil(t, router.PutJSON("billing.charge", "a charge", 0).Error)
+	assert.Nil(t, router.PutString("billing.report", "a report", 0).Error)
+	assert.Nil(t, router.Put("customers.create", "a customer", 0).Error)
+
+	assert.Equal(t, 1, len(session.queues["billing"]))
+	assert.Equal(t, "billing.charge", *session.queues["billing"][0].MessageAttributes["Method"].StringValue)
+	assert.Equal(t, 1, len(session.queues["reports"]))
+	assert.Equal(t, 1, len(session.queues["default"]))
+}
+
+/*
+	Case 2: a method without a route is an error
+*/
+func Test_Router_route_not_found(t *testing.T) {
+	router := NewRouter()
+	router.Route("billing.*", NewSQSQueue(&Mock4ReplyAWSSession{}, "billing"))
+
+	failed := false
+	thenable := router.PutJSON("customers.create", "a customer", 0).Catch(func(err error, msg interface{}) {
+		failed = true
+	})
+
+	assert.Equal(t, ErrorRouteNotFound, thenable.Error)
+	assert.True(t, failed)
+
+	/*
+		The hooks of an unrouted message are called at once, as it's settled
+	*/
+	finished := false
+	thenable.Then(func(msg interface{}) error {
+		t.Error("an unrouted message never completes")
+		return nil
+	}).Finally(func() {
+		finished = true
+	})
+
+	assert.True(t, finished)
+}
+
+/*
+	Case 3: the routes are loaded from config, the queues of the same URL are shared
+*/
+func Test_NewRouterFromConfig(t *testing.T) {
+	session := &Mock4ReplyAWSSession{}
+	router, err := NewRouterFromConfig([]byte(`{
+		"routes": {
+			"billing.*": "billing",
+			"invoices.*": "billing"
+		},
+		"default": "default"
+	}`), session)
+	assert.Nil(t, err)
+
+	billing, err := router.QueueFor("billing.charge")
+	assert.Nil(t, err)
+
+	invoices, err := router.QueueFor("invoices.send")
+	assert.Nil(t, err)
+	assert.True(t, billing == invoices)
+
+	assert.Nil(t, router.PutJSON("customers.create", "a customer", 0).Error)
+	assert.Equal(t, 1, len(session.queues["default"]))
+
+	_, err = NewRouterFromConfig([]byte(`not json`), session)
+	assert.NotNil(t, err)
+}
+
+/*
+	Case 4: the default route and the route * can't be both set
+*/
+func Test_NewRouterFromConfig_default_conflict(t *testing.T) {
+	_, err := NewRouterFromConfig([]byte(`{
+		"routes": {
+			"*": "fallback"
+		},
+		"default": "default"
+	}`), &Mock4ReplyAWSSession{})
+	assert.Equal(t, ErrorDefaultRouteConflict, err)
+}
+
+/*
+	Case 5: PutAfter sends to the queue of the method with the delay
+*/
+func Test_Router_PutAfter(t *testing.T) {
+	session := &MockAWSSessionThen{}
+
+	router := NewRouter()
+	router.Route("billing.*", NewSQSQueue(session, "billing"))
+
+	assert.Nil(t, router.PutAfter("billing.charge", "a charge", 10*time.Second).Error)
+	assert.Equal(t, "billing", *session.input.QueueUrl)
+	assert.Equal(t, int64(10), *session.input.DelaySeconds)
+
+	assert.Equal(t, ErrorRouteNotFound, router.PutAfter("customers.create", "a customer", time.Second).Error)
+}
@@ -0,0 +1,248 @@
+package queue
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/pkg/errors"
+
+	// nolint: depguard
+	log "github.com/sirupsen/logrus"
+)
+
+// SagaStep is a step of a saga, Method does the work and Compensate, if any,
+// undoes it. Both are registered methods
+type SagaStep struct {
+	Method     string
+	Compensate string
+}
+
+// sagaState travels in the Saga attribute of the messages of a saga. The
+// results of the steps may be large, so they travel in the body (1)
+type sagaState struct {
+	Name         string        `json:"name"`
+	Step         int           `json:"step"`
+	Compensating bool          `json:"compensating,omitempty"`
+	Reason       string        `json:"reason,omitempty"`
+	Failed       []string      `json:"failed,omitempty"`
+	Results      []interface{} `json:"-"`
+}
+
+// sagaCodec encodes the messages of a saga as JSON, along with the results of
+// the completed steps. The listeners decode them as any other JSON message
+type sagaCodec struct {
+	results []interface{}
+}
+
+type sagaJSON struct {
+	Msg     interface{}   `json:"msg"`
+	Results []interface{} `json:"saga"`
+}
+
+func (sagaCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (c sagaCodec) Marshal(msg interface{}) ([]byte, error) {
+	return json.Marshal(sagaJSON{
+		Msg:     msg,
+		Results: c.results,
+	})
+}
+
+func (sagaCodec) Unmarshal(data []byte) (interface{}, error) {
+	return jsonCodec{}.Unmarshal(data)
+}
+
+// RegisterSaga defines the saga name as a sequence of steps. Each step gets the
+// result of the previous one. If a step fails for good, the compensations of the
+// completed steps run in reverse order, each with the result of its step. Then
+// the request is settled with ErrorSagaCompensated, or ErrorSagaNotCompensated
+// if some compensation failed for good too. The messages of a saga are JSON
+func (q *queueSQS) RegisterSaga(name string, steps ...SagaStep) {
+	if q.sagaMap == nil {
+		q.sagaMap = map[string][]SagaStep{}
+	}
+
+	q.sagaMap[name] = steps
+}
+
+// PutSaga starts the saga name with msg
+func (q *queueSQS) PutSaga(name string, msg interface{}, delaySeconds int64, opts ...PutOption) *sqsResponseThenable {
+	steps, ok := q.sagaMap[name]
+	if !ok || len(steps) == 0 {
+		thenable := &sqsResponseThenable{
+			queue: q,
+			msg:   msg,
+			Error: ErrorSagaNotFound,
+		}
+		thenable.settle(ErrorSagaNotFound)
+
+		return thenable
+	}
+
+	state := sagaState{
+		Name:    name,
+		Results: []interface{}{},
+	}
+
+	return q.putWith(sagaCodec{state.Results}, steps[0].Method, msg, delaySeconds, append(opts, withSaga(state)))
+}
+
+// advanceSaga sends msg, the result of the current step, to the next step.
+// While compensating, it sends the next compensation instead
+func (q *queueSQS) advanceSaga(m *sqs.Message, state *sagaState, msg interface{}) error {
+	steps, ok := q.sagaMap[state.Name]
+	if !ok {
+		return ErrorSagaNotFound
+	}
+
+	if state.Compensating {
+		return q.sendCompensation(m, steps, state)
+	}
+
+	state.Results = append(state.Results, msg)
+	state.Step++
+
+	if state.Step >= len(steps) {
+		q.settle(m, msg, nil)
+		return nil
+	}
+
+	thenable := q.putWith(sagaCodec{state.Results}, steps[state.Step].Method, msg, 0, []PutOption{withSaga(*state), carry(m)})
+	if thenable.Error != nil {
+		return errors.Wrapf(thenable.Error, "sending to %s", steps[state.Step].Method)
+	}
+
+	return nil
+}
+
+// compensate goes on with the saga of m, that failed for good with reason. A
+// failed step starts the compensations, a failed compensation is recorded and
+// the next one runs anyway. It returns false if m isn't part of a saga
+func (q *queueSQS) compensate(m *sqs.Message, reason error) bool {
+	state, err := q.sagaOf(m)
+	if err != nil {
+		log.Errorf("compensating: %v", err)
+		return false
+	}
+
+	if state == nil {
+		return false
+	}
+
+	steps, ok := q.sagaMap[state.Name]
+	if !ok {
+		log.Errorf("compensating saga %s: %v", state.Name, ErrorSagaNotFound)
+		return false
+	}
+
+	if state.Step >= len(steps) {
+		log.Errorf("compensating saga %s: %v", state.Name, ErrorSagaStateInvalid)
+		return false
+	}
+
+	if state.Compensating {
+		log.Errorf("compensation %s of saga %s failed: %v", steps[state.Step].Compensate, state.Name, reason)
+		state.Failed = append(state.Failed, steps[state.Step].Compensate)
+	} else {
+		state.Compensating = true
+		state.Reason = reason.Error()
+	}
+
+	if err := q.sendCompensation(m, steps, state); err != nil {
+		log.Errorf("compensating saga %s: %v", state.Name, err)
+		q.settle(m, nil, err)
+	}
+
+	return true
+}
+
+// sendCompensation sends the compensation of the completed step before
+// state.Step. Once there is none left the request is settled
+func (q *queueSQS) sendCompensation(m *sqs.Message, steps []SagaStep, state *sagaState) error {
+	for state.Step--; state.Step >= 0; state.Step-- {
+		step := steps[state.Step]
+		if step.Compensate == "" {
+			continue
+		}
+
+		thenable := q.putWith(sagaCodec{state.Results}, step.Compensate, state.Results[state.Step], 0, []PutOption{withSaga(*state), carry(m)})
+		if thenable.Error != nil {
+			return errors.Wrapf(thenable.Error, "sending to %s", step.Compensate)
+		}
+
+		return nil
+	}
+
+	q.settle(m, nil, state.outcome())
+
+	return nil
+}
+
+// outcome is the error that settles a compensated saga
+func (state *sagaState) outcome() error {
+	if len(state.Failed) > 0 {
+		return errors.Wrapf(ErrorSagaNotCompensated, "%s, failed %s", state.Reason, strings.Join(state.Failed, ", "))
+	}
+
+	return errors.Wrap(ErrorSagaCompensated, state.Reason)
+}
+
+func withSaga(state sagaState) PutOption {
+	return func(messageAttributes map[string]*sqs.MessageAttributeValue) {
+		value, err := json.Marshal(state)
+		if err != nil {
+			log.Errorf("saga %s state: %v", state.Name, err)
+			return
+		}
+
+		messageAttributes["Saga"] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(string(value)),
+		}
+	}
+}
+
+// sagaOf reads the saga of m, its state from the Saga attribute and the results
+// of its steps from the body
+func (q *queueSQS) sagaOf(m *sqs.Message) (*sagaState, error) {
+	stateAttr, ok := m.MessageAttributes["Saga"]
+	if !ok || stateAttr == nil {
+		return nil, nil
+	}
+
+	state := sagaState{}
+	if err := json.Unmarshal([]byte(aws.StringValue(stateAttr.StringValue)), &state); err != nil {
+		return nil, errors.Wrap(err, "Incorrect value of Saga")
+	}
+
+	data, err := q.bodyData(m)
+	if err != nil {
+		return nil, err
+	}
+
+	body := sagaJSON{}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, errors.Wrap(err, "Incorrect body of a saga")
+	}
+
+	state.Results = body.Results
+	if state.Results == nil {
+		state.Results = []interface{}{}
+	}
+
+	if state.Step < 0 || state.Step > len(state.Results) {
+		return nil, ErrorSagaStateInvalid
+	}
+
+	return &state, nil
+}
+
+/*
+(1) The SQS attributes take up to 256KB along with the body, and all of them
+	are packed into x-meta. The results grow with each step, so they go along
+	the body, which is offloaded to the blob store once it's too large.
+*/
@@ -0,0 +1,199 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+	Case 1: each step gets the result of the previous one, the last result is the reply
+*/
+func Test_saga_completes(t *testing.T) {
+	session := &Mock4ReplyAWSSession{}
+	queue := NewSQSQueue(session, "requests", WithReplyQueue("replies"))
+
+	queue.RegisterReply("customer.create", func(msg interface{}) (interface{}, error) {
+		return msg.(string) + " created", nil
+	})
+	queue.RegisterReply("card.charge", func(msg interface{}) (interface{}, error) {
+		return msg.(string) + ", charged", nil
+	})
+	queue.RegisterSaga("signup",
+		SagaStep{Method: "customer.create", Compensate: "customer.delete"},
+		SagaStep{Method: "card.charge", Compensate: "card.refund"},
+	)
+
+	go queue.Listen()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := queue.PutSaga("signup", "john", 0, ExpectReply()).Await(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "john created, charged", result)
+}
+
+/*
+	Case 2: once a step fails for good the completed steps are compensated in reverse order
+*/
+func Test_saga_compensates_in_reverse_order(t *testing.T) {
+	session := &Mock4ReplyAWSSession{}
+	queue := NewSQSQueue(session, "requests")
+
+	compensated := make(chan string, 2)
+
+	queue.RegisterReply("customer.create", func(msg interface{}) (interface{}, error) {
+		return "customer-1", nil
+	})
+	queue.RegisterReply("card.charge", func(msg interface{}) (interface{}, error) {
+		return "charge-1", nil
+	})
+	queue.Register("email.send", func(msg interface{}) error {
+		return errors.New("intentional error")
+	})
+	queue.Register("customer.delete", func(msg interface{}) error {
+		compensated <- "customer.delete " + msg.(string)
+		return nil
+	})
+	queue.Register("card.refund", func(msg interface{}) error {
+		compensated <- "card.refund " + msg.(string)
+		return nil
+	})
+	queue.RegisterSaga("signup",
+		SagaStep{Method: "customer.create", Compensate: "customer.delete"},
+		SagaStep{Method: "card.charge", Compensate: "card.refund"},
+		SagaStep{Method: "email.send"},
+	)
+
+	go queue.Listen()
+
+	assert.Nil(t, queue.PutSaga("signup", "john", 0).Error)
+
+	assert.Equal(t, "card.refund charge-1", <-compensated)
+	assert.Equal(t, "customer.delete customer-1", <-compensated)
+}
+
+/*
+	Case 3: unknown sagas and broken states are errors
+*/
+func Test_saga_errors(t *testing.T) {
+	queue := NewSQSQueue(&Mock4ReplyAWSSession{}, "requests").(*queueSQS)
+
+	assert.Equal(t, ErrorSagaNotFound, queue.PutSaga("unknown", "a message", 0).Error)
+
+	msg := &sqs.Message{
+		Body: aws.String(`{"msg":"a message","saga":[]}`),
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			"Saga": {
+				DataType:    aws.String("String"),
+				StringValue: aws.String(`{"name":"signup","step":3}`),
+			},
+		},
+	}
+
+	_, err := queue.continueChain(msg, "a message", nil)
+	assert.Equal(t, ErrorSagaStateInvalid, err)
+}
+
+/*
+	Case 4: the results travel in the body, the Saga attribute keeps only the state
+*/
+func Test_saga_results_in_body(t *testing.T) {
+	session := &Mock4EncryptAWSSession{sent: make(chan *sqs.SendMessageInput, 2)}
+	queue := NewSQSQueue(session, "requests").(*queueSQS)
+
+	queue.RegisterSaga("signup",
+		SagaStep{Method: "customer.create", Compensate: "customer.delete"},
+		SagaStep{Method: "card.charge", Compensate: "card.refund"},
+	)
+
+	assert.Nil(t, queue.PutSaga("signup", "john", 0).Error)
+
+	m := receivedMessage(<-session.sent)
+	assert.Nil(t, queue.advanceSaga(m, &sagaState{Name: "signup", Results: []interface{}{}}, "customer-1"))
+
+	next := receivedMessage(<-session.sent)
+	assert.Equal(t, `{"msg":"customer-1","saga":["customer-1"]}`, *next.Body)
+	assert.Equal(t, `{"name":"signup","step":1}`, *next.MessageAttributes["Saga"].StringValue)
+
+	state, err := queue.sagaOf(next)
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"customer-1"}, state.Results)
+}
+
+/*
+	Case 5: a failed compensation doesn't stop the rest, and the request is settled once they are done
+*/
+func Test_saga_compensation_fails(t *testing.T) {
+	session := &Mock4ReplyAWSSession{}
+	queue := NewSQSQueue(session, "requests", WithReplyQueue("replies"))
+
+	compensated := make(chan string, 1)
+
+	queue.RegisterReply("customer.create", func(msg interface{}) (interface{}, error) {
+		return "customer-1", nil
+	})
+	queue.RegisterReply("card.charge", func(msg interface{}) (interface{}, error) {
+		return "charge-1", nil
+	})
+	queue.Register("email.send", func(msg interface{}) error {
+		return Permanent(errors.New("intentional error"))
+	})
+	queue.Register("card.refund", func(msg interface{}) error {
+		return Permanent(errors.New("refund error"))
+	})
+	queue.Register("customer.delete", func(msg interface{}) error {
+		compensated <- "customer.delete " + msg.(string)
+		return nil
+	})
+	queue.RegisterSaga("signup",
+		SagaStep{Method: "customer.create", Compensate: "customer.delete"},
+		SagaStep{Method: "card.charge", Compensate: "card.refund"},
+		SagaStep{Method: "email.send"},
+	)
+
+	go queue.Listen()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := queue.PutSaga("signup", "john", 0, ExpectReply()).Await(ctx)
+	assert.Equal(t, "customer.delete customer-1", <-compensated)
+	assert.EqualError(t, err, "intentional error, failed card.refund: "+ErrorSagaNotCompensated.Error())
+}
+
+/*
+	Case 6: the request of a compensated saga is settled with ErrorSagaCompensated
+*/
+func Test_saga_compensated_reply(t *testing.T) {
+	session := &Mock4ReplyAWSSession{}
+	queue := NewSQSQueue(session, "requests", WithReplyQueue("replies"))
+
+	queue.RegisterReply("customer.create", func(msg interface{}) (interface{}, error) {
+		return "customer-1", nil
+	})
+	queue.Register("card.charge", func(msg interface{}) error {
+		return Permanent(errors.New("intentional error"))
+	})
+	queue.Register("customer.delete", func(msg interface{}) error {
+		return nil
+	})
+	queue.RegisterSaga("signup",
+		SagaStep{Method: "customer.create", Compensate: "customer.delete"},
+		SagaStep{Method: "card.charge"},
+	)
+
+	go queue.Listen()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := queue.PutSaga("signup", "john", 0, ExpectReply()).Await(ctx)
+	assert.EqualError(t, err, "intentional error: "+ErrorSagaCompensated.Error())
+}
@@ -0,0 +1,100 @@
+package queue
+
+import (
+	"math"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/pkg/errors"
+)
+
+// maxDelaySeconds is the longest delay SQS accepts
+const maxDelaySeconds = 900
+
+// PutAt sends msg to be handled at the given time. Beyond the SQS delay limit,
+// the message hops through the queue until it's due
+func (q *queueSQS) PutAt(method string, msg interface{}, at time.Time, opts ...PutOption) *sqsResponseThenable {
+	return q.Put(method, msg, delayUntil(at), append(opts, withDeliverAt(at))...)
+}
+
+// PutAfter sends msg to be handled once the duration has passed
+func (q *queueSQS) PutAfter(method string, msg interface{}, after time.Duration, opts ...PutOption) *sqsResponseThenable {
+	return q.PutAt(method, msg, time.Now().Add(after), opts...)
+}
+
+// delayUntil returns the delay of the next hop to at
+func delayUntil(at time.Time) int64 {
+	delaySeconds := int64(math.Ceil(time.Until(at).Seconds()))
+
+	switch {
+	case delaySeconds < 0:
+		return 0
+	case delaySeconds > maxDelaySeconds:
+		return maxDelaySeconds
+	}
+
+	return delaySeconds
+}
+
+func withDeliverAt(at time.Time) PutOption {
+	return func(messageAttributes map[string]*sqs.MessageAttributeValue) {
+		messageAttributes["DeliverAt"] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(at.UTC().Format(time.RFC3339Nano)),
+		}
+	}
+}
+
+func deliverAt(m *sqs.Message) (time.Time, error) {
+	atAttr, ok := m.MessageAttributes["DeliverAt"]
+	if !ok || atAttr == nil {
+		return time.Time{}, nil
+	}
+
+	at, err := time.Parse(time.RFC3339Nano, aws.StringValue(atAttr.StringValue))
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "Incorrect value of DeliverAt")
+	}
+
+	return at, nil
+}
+
+// hop sends m again if it isn't due yet, and tells if it did
+func (q *queueSQS) hop(m *sqs.Message) (bool, error) {
+	at, err := deliverAt(m)
+	if err != nil || at.IsZero() {
+		return false, err
+	}
+
+	delaySeconds := delayUntil(at)
+	if delaySeconds == 0 {
+		return false, nil
+	}
+
+	/*
+		The hops aren't retries, so the copy keeps its NextDelayRetry: the one
+		PutAt set, or the one of the retry that is waiting
+	*/
+
+	return true, q.requeue(m, delaySeconds)
+}
+
+// requeue sends a copy of m after delaySeconds, without counting it as a retry.
+// opts change the attributes of the copy
+func (q *queueSQS) requeue(m *sqs.Message, delaySeconds int64, opts ...PutOption) error {
+	requeueAttributes := map[string]*sqs.MessageAttributeValue{}
+	for name, attr := range m.MessageAttributes {
+		requeueAttributes[name] = attr
+	}
+
+	for _, opt := range opts {
+		opt(requeueAttributes)
+	}
+
+	if _, err := q.send(aws.StringValue(m.Body), delaySeconds, requeueAttributes); err != nil {
+		return errors.Wrap(err, "requeueing message")
+	}
+
+	return nil
+}
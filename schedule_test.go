@@ -0,0 +1,90 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+	Case 1: beyond the SQS limit the first hop takes the longest delay
+*/
+func Test_PutAfter_beyond_limit(t *testing.T) {
+	session := &MockAWSSessionThen{}
+	queue := NewSQSQueue(session, "requests")
+
+	assert.Nil(t, queue.PutAfter("method", "a message", 2*time.Hour).Error)
+	assert.Equal(t, int64(maxDelaySeconds), *session.input.DelaySeconds)
+	assert.Equal(t, "1", *session.input.MessageAttributes["NextDelayRetry"].StringValue)
+
+	at, err := time.Parse(time.RFC3339Nano, attributeOf(session.input, "DeliverAt"))
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now().Add(2*time.Hour), at, time.Minute)
+}
+
+/*
+	Case 2: within the SQS limit the message is sent with the remaining delay
+*/
+func Test_PutAt_within_limit(t *testing.T) {
+	session := &MockAWSSessionThen{}
+	queue := NewSQSQueue(session, "requests")
+
+	assert.Nil(t, queue.PutAt("method", "a message", time.Now().Add(90*time.Second)).Error)
+	assert.InDelta(t, 90, *session.input.DelaySeconds, 1)
+}
+
+/*
+	Case 3: a message that isn't due hops again with the remaining delay
+*/
+func Test_handleMessage_not_due_hops(t *testing.T) {
+	session := &Mock4EncryptAWSSession{sent: make(chan *sqs.SendMessageInput, 1)}
+	queue := NewSQSQueue(session, "requests").(*queueSQS)
+
+	assert.Nil(t, queue.PutAfter("method", "a message", time.Hour).Error)
+	input := <-session.sent
+
+	/*
+		The hop arrives 900 seconds later
+	*/
+	m := receivedMessage(input)
+	at, _ := time.Parse(time.RFC3339Nano, *m.MessageAttributes["DeliverAt"].StringValue)
+	m.MessageAttributes["DeliverAt"] = &sqs.MessageAttributeValue{
+		DataType:    aws.String("String"),
+		StringValue: aws.String(at.Add(-maxDelaySeconds * time.Second).Format(time.RFC3339Nano)),
+	}
+
+	handled := false
+	assert.Nil(t, queue.handleMessage(func(msg interface{}) error {
+		handled = true
+		return nil
+	}, m))
+
+	hop := <-session.sent
+	assert.False(t, handled)
+	assert.Equal(t, int64(maxDelaySeconds), *hop.DelaySeconds)
+	assert.Equal(t, *input.MessageBody, *hop.MessageBody)
+	assert.Equal(t, *m.MessageAttributes["DeliverAt"].StringValue, attributeOf(hop, "DeliverAt"))
+}
+
+/*
+	Case 4: a message that is due goes to its handler
+*/
+func Test_handleMessage_due(t *testing.T) {
+	session := &Mock4EncryptAWSSession{sent: make(chan *sqs.SendMessageInput, 1)}
+	queue := NewSQSQueue(session, "requests").(*queueSQS)
+
+	assert.Nil(t, queue.PutAt("method", "a message", time.Now().Add(-time.Second)).Error)
+	input := <-session.sent
+	assert.Equal(t, int64(0), *input.DelaySeconds)
+
+	handled := make(chan interface{}, 1)
+	assert.Nil(t, queue.handleMessage(func(msg interface{}) error {
+		handled <- msg
+		return nil
+	}, receivedMessage(input)))
+
+	assert.Equal(t, "a message", <-handled)
+}
@@ -0,0 +1,97 @@
+package queue
+
+import (
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/pkg/errors"
+)
+
+// Upcaster transforms a message of a schema version into the next one
+type Upcaster func(msg interface{}) (interface{}, error)
+
+// WithSchemaVersion sets the current schema version of the messages of method.
+// Messages sent without version are version 0
+func WithSchemaVersion(method string, version int) Option {
+	return func(q *queueSQS) {
+		if q.schemaVersions == nil {
+			q.schemaVersions = map[string]int{}
+		}
+
+		q.schemaVersions[method] = version
+	}
+}
+
+// WithUpcaster registers the upcaster that turns the messages of method from
+// fromVersion into fromVersion+1. The current schema version of method becomes
+// at least fromVersion+1
+func WithUpcaster(method string, fromVersion int, upcaster Upcaster) Option {
+	return func(q *queueSQS) {
+		if q.upcasters == nil {
+			q.upcasters = map[string]map[int]Upcaster{}
+		}
+
+		if q.upcasters[method] == nil {
+			q.upcasters[method] = map[int]Upcaster{}
+		}
+
+		q.upcasters[method][fromVersion] = upcaster
+
+		if q.schemaVersions[method] < fromVersion+1 {
+			WithSchemaVersion(method, fromVersion+1)(q)
+		}
+	}
+}
+
+// stampSchemaVersion records the current schema version of method in the attributes
+func (q *queueSQS) stampSchemaVersion(method string, messageAttributes map[string]*sqs.MessageAttributeValue) {
+	version, ok := q.schemaVersions[method]
+	if !ok {
+		return
+	}
+
+	messageAttributes["SchemaVersion"] = &sqs.MessageAttributeValue{
+		DataType:    aws.String("Number"),
+		StringValue: aws.String(strconv.Itoa(version)),
+	}
+}
+
+// upcast brings msg from the schema version of the message to the current one
+func (q *queueSQS) upcast(msg interface{}, m *sqs.Message) (interface{}, error) {
+	method := ""
+	if methodAttr, ok := m.MessageAttributes["Method"]; ok && methodAttr != nil {
+		method = aws.StringValue(methodAttr.StringValue)
+	}
+
+	version := 0
+	if versionAttr, ok := m.MessageAttributes["SchemaVersion"]; ok && versionAttr != nil {
+		value, err := strconv.Atoi(aws.StringValue(versionAttr.StringValue))
+		if err != nil {
+			return nil, errors.Wrap(err, "Incorrect value of SchemaVersion")
+		}
+
+		version = value
+	}
+
+	current := q.schemaVersions[method]
+	if version > current {
+		return nil, ErrorSchemaVersionUnknown
+	}
+
+	for ; version < current; version++ {
+		upcaster, ok := q.upcasters[method][version]
+		if !ok {
+			return nil, errors.Wrapf(ErrorUpcasterNotFound, "%s from version %d", method, version)
+		}
+
+		upcasted, err := upcaster(msg)
+		if err != nil {
+			return nil, errors.Wrapf(err, "upcasting %s from version %d", method, version)
+		}
+
+		msg = upcasted
+	}
+
+	return msg, nil
+}
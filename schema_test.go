@@ -0,0 +1,97 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+)
+
+// renameField is the upcaster from version 0 to 1, "name" became "full_name"
+func renameField(msg interface{}) (interface{}, error) {
+	fields := msg.(map[string]interface{})
+	fields["full_name"] = fields["name"]
+	delete(fields, "name")
+
+	return fields, nil
+}
+
+// addCountry is the upcaster from version 1 to 2, "country" is required now
+func addCountry(msg interface{}) (interface{}, error) {
+	fields := msg.(map[string]interface{})
+	fields["country"] = "unknown"
+
+	return fields, nil
+}
+
+/*
+	Case 1: Put records the current schema version of the method
+*/
+func Test_schema_version_stamped(t *testing.T) {
+	session := &MockAWSSessionThen{}
+	queue := NewSQSQueue(session, "", WithUpcaster("customer", 0, renameField), WithUpcaster("customer", 1, addCountry))
+
+	assert.Nil(t, queue.PutJSON("customer", map[string]interface{}{}, 0).Error)
+	assert.Equal(t, "2", attributeOf(session.input, "SchemaVersion"))
+
+	assert.Nil(t, queue.PutJSON("other", map[string]interface{}{}, 0).Error)
+	assert.NotContains(t, attributesOf(session.input), "SchemaVersion")
+}
+
+/*
+	Case 2: old messages, even without version, are upcasted to the current version
+*/
+func Test_schema_upcast_old_messages(t *testing.T) {
+	session := &MockAWSSessionThen{}
+	before := NewSQSQueue(session, "", WithSchemaVersion("customer", 1))
+	after := NewSQSQueue(session, "", WithUpcaster("customer", 0, renameField), WithUpcaster("customer", 1, addCountry)).(*queueSQS)
+
+	assert.Nil(t, before.PutJSON("customer", map[string]interface{}{"full_name": "John"}, 0).Error)
+
+	actual, err := after.decode(receivedMessage(session.input))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"full_name": "John", "country": "unknown"}, actual)
+
+	msg := &sqs.Message{
+		Body: aws.String(`{"msg":{"name":"John"}}`),
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			"Method": {
+				DataType:    aws.String("String"),
+				StringValue: aws.String("customer"),
+			},
+		},
+	}
+
+	actual, err = after.decode(msg)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"full_name": "John", "country": "unknown"}, actual)
+}
+
+/*
+	Case 3: messages newer than the listener or with a gap in the upcasters fail
+*/
+func Test_schema_upcast_errors(t *testing.T) {
+	session := &MockAWSSessionThen{}
+	newer := NewSQSQueue(session, "", WithSchemaVersion("customer", 3))
+	queue := NewSQSQueue(session, "", WithUpcaster("customer", 1, addCountry)).(*queueSQS)
+
+	assert.Nil(t, newer.PutJSON("customer", map[string]interface{}{}, 0).Error)
+
+	_, err := queue.decode(receivedMessage(session.input))
+	assert.Equal(t, ErrorSchemaVersionUnknown, err)
+
+	msg := &sqs.Message{
+		Body: aws.String(`{"msg":{"name":"John"}}`),
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			"Method": {
+				DataType:    aws.String("String"),
+				StringValue: aws.String("customer"),
+			},
+		},
+	}
+
+	_, err = queue.decode(msg)
+	assert.NotNil(t, err)
+	assert.Equal(t, "customer from version 0: "+ErrorUpcasterNotFound.Error(), err.Error())
+}
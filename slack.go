@@ -0,0 +1,342 @@
+package queue
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/websocket"
+
+	// nolint: depguard
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	slackConnectionsOpenURL        = "https://slack.com/api/apps.connections.open"
+	slackReconnectSecondsDefault   = 5
+	slackReadTimeoutSecondsDefault = 120
+	slackMethodPrefix              = "slack."
+	slackEnvelopeHello             = "hello"
+	slackEnvelopeDisconnect        = "disconnect"
+	slackEnvelopeEventsAPI         = "events_api"
+	slackEnvelopeInteractive       = "interactive"
+	slackIdempotencyKeyPrefix      = "slack:"
+	slackWebsocketOriginDefault    = "https://localhost"
+	slackConnectionsOpenBodyBytes  = 64 * 1024
+)
+
+// slackEnvelopeID finds the envelope id of a frame that isn't valid JSON
+var slackEnvelopeID = regexp.MustCompile(`"envelope_id"\s*:\s*"([^"\\]*)"`)
+
+type slackEnvelope struct {
+	EnvelopeID string          `json:"envelope_id"`
+	Type       string          `json:"type"`
+	Reason     string          `json:"reason,omitempty"`
+	Payload    json.RawMessage `json:"payload,omitempty"`
+}
+
+type slackAck struct {
+	EnvelopeID string `json:"envelope_id"`
+}
+
+// SlackSource reads the events of a Slack app through Socket Mode and puts
+// them into the queue. The method of an event is slack.<envelope type>, plus
+// the type of the event if it has one, e.g. slack.events_api.app_mention or
+// slack.slash_commands, so RoutePrefix handlers may take a whole family
+type SlackSource struct {
+	queue     SQSQueue
+	token     string
+	openURL   string
+	client    *http.Client
+	reconnect time.Duration
+	timeout   time.Duration
+	mutex     sync.Mutex
+	conn      *websocket.Conn
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+// SlackOption configures the source returned by NewSlackSource
+type SlackOption func(s *SlackSource)
+
+// WithSlackAPI sets the URL of apps.connections.open, e.g. for a stand-in
+func WithSlackAPI(url string) SlackOption {
+	return func(s *SlackSource) {
+		s.openURL = url
+	}
+}
+
+// WithSlackHTTPClient sets the client that opens the connections
+func WithSlackHTTPClient(client *http.Client) SlackOption {
+	return func(s *SlackSource) {
+		s.client = client
+	}
+}
+
+// WithReconnectWait sets how long the source waits before connecting again
+// after a failed connection
+func WithReconnectWait(wait time.Duration) SlackOption {
+	return func(s *SlackSource) {
+		s.reconnect = wait
+	}
+}
+
+// WithSlackReadTimeout sets how long the source waits for a frame before it
+// takes the connection as dropped and connects again
+func WithSlackReadTimeout(timeout time.Duration) SlackOption {
+	return func(s *SlackSource) {
+		s.timeout = timeout
+	}
+}
+
+// NewSlackSource returns a source that connects with the app-level token and
+// puts the events into queue
+func NewSlackSource(queue SQSQueue, token string, opts ...SlackOption) *SlackSource {
+	s := &SlackSource{
+		queue:     queue,
+		token:     token,
+		openURL:   slackConnectionsOpenURL,
+		client:    http.DefaultClient,
+		reconnect: slackReconnectSecondsDefault * time.Second,
+		timeout:   slackReadTimeoutSecondsDefault * time.Second,
+		stop:      make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// Run connects, and connects again each time Slack or the network drops the
+// connection, until Stop
+func (s *SlackSource) Run() {
+	for {
+		ws, err := s.connect()
+		if err == nil {
+			err = s.serve(ws)
+		}
+
+		if err != nil {
+			log.Errorf("slack socket mode: %v", err)
+		}
+
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+
+		if err == nil {
+			continue
+		}
+
+		timer := time.NewTimer(s.reconnect)
+
+		select {
+		case <-s.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Stop closes the connection and ends Run
+func (s *SlackSource) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		if s.conn != nil {
+			s.conn.Close()
+		}
+	})
+}
+
+// connect asks Slack for a websocket URL and dials it
+func (s *SlackSource) connect() (*websocket.Conn, error) {
+	req, err := http.NewRequest(http.MethodPost, s.openURL, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "building apps.connections.open request")
+	}
+
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "apps.connections.open request error")
+	}
+	defer resp.Body.Close()
+
+	opened := struct {
+		OK    bool   `json:"ok"`
+		URL   string `json:"url"`
+		Error string `json:"error"`
+	}{}
+
+	decoder := json.NewDecoder(io.LimitReader(resp.Body, slackConnectionsOpenBodyBytes))
+	if err := decoder.Decode(&opened); err != nil {
+		return nil, errors.Wrap(err, "json unmarshal error")
+	}
+
+	if !opened.OK {
+		return nil, errors.Errorf("apps.connections.open: %s", opened.Error)
+	}
+
+	ws, err := websocket.Dial(opened.URL, "", slackWebsocketOriginDefault)
+	if err != nil {
+		return nil, errors.Wrapf(err, "dialing %s", opened.URL)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	select {
+	case <-s.stop:
+		ws.Close()
+		return nil, nil
+	default:
+	}
+
+	s.conn = ws
+
+	return ws, nil
+}
+
+// serve reads the envelopes of ws until Slack asks to reconnect, which returns
+// nil, or the connection fails. A connection without frames for the read
+// timeout is taken as failed
+func (s *SlackSource) serve(ws *websocket.Conn) error {
+	if ws == nil {
+		return nil
+	}
+
+	defer ws.Close()
+
+	for {
+		if err := ws.SetReadDeadline(time.Now().Add(s.timeout)); err != nil {
+			return errors.Wrap(err, "setting read deadline")
+		}
+
+		var frame []byte
+		if err := websocket.Message.Receive(ws, &frame); err != nil {
+			select {
+			case <-s.stop:
+				return nil
+			default:
+			}
+
+			return errors.Wrap(err, "receiving envelope")
+		}
+
+		envelope := slackEnvelope{}
+		if err := json.Unmarshal(frame, &envelope); err != nil {
+			/*
+				Slack would send it again and again, so it's acked, if it
+				has an id, and dropped
+			*/
+			id := envelopeIDOf(frame, &envelope)
+			log.Errorf("slack socket mode: dropping envelope %s: %v", id, err)
+
+			if id == "" {
+				continue
+			}
+
+			if err := websocket.JSON.Send(ws, &slackAck{EnvelopeID: id}); err != nil {
+				return errors.Wrap(err, "sending ack")
+			}
+
+			continue
+		}
+
+		switch envelope.Type {
+		case slackEnvelopeHello:
+			continue
+		case slackEnvelopeDisconnect:
+			log.Infof("slack socket mode: disconnect %s", envelope.Reason)
+			return nil
+		}
+
+		if envelope.EnvelopeID == "" {
+			continue
+		}
+
+		if err := s.enqueue(&envelope); err != nil {
+			// without the ack Slack sends the envelope again
+			log.Errorf("slack socket mode: %v", err)
+			continue
+		}
+
+		if err := websocket.JSON.Send(ws, &slackAck{EnvelopeID: envelope.EnvelopeID}); err != nil {
+			return errors.Wrap(err, "sending ack")
+		}
+	}
+}
+
+// envelopeIDOf returns the id of a frame that couldn't be decoded into
+// envelope. A syntax error stops the decoding before the id, so it's looked up
+// in the frame itself
+func envelopeIDOf(frame []byte, envelope *slackEnvelope) string {
+	if envelope.EnvelopeID != "" {
+		return envelope.EnvelopeID
+	}
+
+	if match := slackEnvelopeID.FindSubmatch(frame); match != nil {
+		return string(match[1])
+	}
+
+	return ""
+}
+
+// enqueue puts the payload of envelope. The envelopes sent again carry the same
+// id, so with a dedup store the listener handles only one of them
+func (s *SlackSource) enqueue(envelope *slackEnvelope) error {
+	method := slackMethod(envelope)
+	key := IdempotencyKey(slackIdempotencyKeyPrefix + envelope.EnvelopeID)
+
+	if thenable := s.queue.PutJSON(method, envelope.Payload, 0, key); thenable.Error != nil {
+		return errors.Wrapf(thenable.Error, "sending to %s", method)
+	}
+
+	return nil
+}
+
+// slackMethod derives the method of envelope from its type and, for the events
+// and the interactions, from the type of its payload
+func slackMethod(envelope *slackEnvelope) string {
+	method := slackMethodPrefix + envelope.Type
+
+	inner := struct {
+		Type  string `json:"type"`
+		Event struct {
+			Type string `json:"type"`
+		} `json:"event"`
+	}{}
+
+	if err := json.Unmarshal(envelope.Payload, &inner); err != nil {
+		return method
+	}
+
+	switch envelope.Type {
+	case slackEnvelopeEventsAPI:
+		if inner.Event.Type != "" {
+			return method + "." + strings.ToLower(inner.Event.Type)
+		}
+	case slackEnvelopeInteractive:
+		if inner.Type != "" {
+			return method + "." + strings.ToLower(inner.Type)
+		}
+	}
+
+	return method
+}
@@ -0,0 +1,220 @@
+package queue
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+)
+
+// slackStandIn serves apps.connections.open and a websocket that plays one
+// script of envelopes per connection, sending the acks it gets to acks
+func slackStandIn(scripts [][]string, acks chan string) *httptest.Server {
+	connections := make(chan []string, len(scripts))
+	for _, script := range scripts {
+		connections <- script
+	}
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+
+	mux.HandleFunc("/apps.connections.open", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer xapp-token" {
+			_, _ = w.Write([]byte(`{"ok":false,"error":"invalid_auth"}`))
+			return
+		}
+
+		url := "ws" + strings.TrimPrefix(server.URL, "http") + "/link"
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "url": url})
+	})
+
+	mux.Handle("/link", websocket.Handler(func(ws *websocket.Conn) {
+		_ = websocket.Message.Send(ws, `{"type":"hello"}`)
+
+		var script []string
+		select {
+		case script = <-connections:
+		default:
+		}
+
+		for _, envelope := range script {
+			if err := websocket.Message.Send(ws, envelope); err != nil {
+				return
+			}
+
+			if strings.Contains(envelope, `"disconnect"`) {
+				return
+			}
+
+			ack := slackAck{}
+			if err := websocket.JSON.Receive(ws, &ack); err != nil {
+				return
+			}
+
+			acks <- ack.EnvelopeID
+		}
+
+		// hold the connection until the source closes it
+		_ = websocket.JSON.Receive(ws, &slackAck{})
+	}))
+
+	return server
+}
+
+/*
+	Case 1: the events are enqueued and acked, and the source reconnects on disconnect
+*/
+func Test_SlackSource_Run(t *testing.T) {
+	acks := make(chan string, 2)
+	server := slackStandIn([][]string{
+		{
+			`{"envelope_id":"env-1","type":"events_api","payload":{"event":{"type":"app_mention","text":"hi"}}}`,
+			`{"type":"disconnect","reason":"refresh_requested"}`,
+		},
+		{
+			`{"envelope_id":"env-2","type":"slash_commands","payload":{"command":"/deploy"}}`,
+		},
+	}, acks)
+	defer server.Close()
+
+	session := &Mock4EncryptAWSSession{sent: make(chan *sqs.SendMessageInput, 2)}
+	source := NewSlackSource(NewSQSQueue(session, "requests"), "xapp-token",
+		WithSlackAPI(server.URL+"/apps.connections.open"),
+		WithReconnectWait(10*time.Millisecond),
+	)
+
+	done := make(chan bool)
+	go func() {
+		source.Run()
+		close(done)
+	}()
+
+	first := <-session.sent
+	assert.Equal(t, "slack.events_api.app_mention", *first.MessageAttributes["Method"].StringValue)
+	assert.Equal(t, "slack:env-1", attributeOf(first, "IdempotencyKey"))
+	assert.Equal(t, `{"msg":{"event":{"type":"app_mention","text":"hi"}}}`, *first.MessageBody)
+	assert.Equal(t, "env-1", <-acks)
+
+	second := <-session.sent
+	assert.Equal(t, "slack.slash_commands", *second.MessageAttributes["Method"].StringValue)
+	assert.Equal(t, "env-2", <-acks)
+
+	source.Stop()
+	<-done
+}
+
+/*
+	Case 2: a refused connection is an error
+*/
+func Test_SlackSource_connect_refused(t *testing.T) {
+	server := slackStandIn(nil, nil)
+	defer server.Close()
+
+	source := NewSlackSource(NewSQSQueue(&MockAWSSessionThen{}, "requests"), "wrong-token",
+		WithSlackAPI(server.URL+"/apps.connections.open"),
+	)
+
+	_, err := source.connect()
+	assert.EqualError(t, err, "apps.connections.open: invalid_auth")
+}
+
+/*
+	Case 3: the method comes from the type of the envelope and of its payload
+*/
+func Test_slackMethod(t *testing.T) {
+	cases := map[string]string{
+		`{"type":"events_api","payload":{"event":{"type":"message"}}}`: "slack.events_api.message",
+		`{"type":"interactive","payload":{"type":"block_actions"}}`:    "slack.interactive.block_actions",
+		`{"type":"slash_commands","payload":{"command":"/deploy"}}`:    "slack.slash_commands",
+		`{"type":"events_api","payload":{"event":{}}}`:                 "slack.events_api",
+		`{"type":"interactive","payload":{"type":"view_submission"}}`:  "slack.interactive.view_submission",
+	}
+
+	for data, expected := range cases {
+		envelope := slackEnvelope{}
+		assert.Nil(t, json.Unmarshal([]byte(data), &envelope))
+		assert.Equal(t, expected, slackMethod(&envelope), data)
+	}
+}
+
+/*
+	Case 4: an envelope that can't be read is acked and dropped, the next ones go on
+*/
+func Test_SlackSource_bad_envelope(t *testing.T) {
+	acks := make(chan string, 3)
+	server := slackStandIn([][]string{
+		{
+			`{"envelope_id":"env-bad","type":5}`,
+			`{"type":"events_api", "envelope_id" : "env-broken","payload":{`,
+			`{"envelope_id":"env-1","type":"slash_commands","payload":{"command":"/deploy"}}`,
+		},
+	}, acks)
+	defer server.Close()
+
+	session := &Mock4EncryptAWSSession{sent: make(chan *sqs.SendMessageInput, 2)}
+	source := NewSlackSource(NewSQSQueue(session, "requests"), "xapp-token",
+		WithSlackAPI(server.URL+"/apps.connections.open"),
+	)
+
+	done := make(chan bool)
+	go func() {
+		source.Run()
+		close(done)
+	}()
+
+	assert.Equal(t, "env-bad", <-acks)
+	assert.Equal(t, "env-broken", <-acks)
+	assert.Equal(t, "env-1", <-acks)
+
+	sent := <-session.sent
+	assert.Equal(t, "slack:env-1", attributeOf(sent, "IdempotencyKey"))
+	assert.Empty(t, session.sent)
+
+	source.Stop()
+	<-done
+}
+
+/*
+	Case 5: a connection without frames for the read timeout is dropped and opened again
+*/
+func Test_SlackSource_read_timeout(t *testing.T) {
+	acks := make(chan string, 1)
+	server := slackStandIn([][]string{
+		{},
+		{
+			`{"envelope_id":"env-1","type":"slash_commands","payload":{"command":"/deploy"}}`,
+		},
+	}, acks)
+	defer server.Close()
+
+	session := &Mock4EncryptAWSSession{sent: make(chan *sqs.SendMessageInput, 1)}
+	source := NewSlackSource(NewSQSQueue(session, "requests"), "xapp-token",
+		WithSlackAPI(server.URL+"/apps.connections.open"),
+		WithReconnectWait(10*time.Millisecond),
+		WithSlackReadTimeout(100*time.Millisecond),
+	)
+
+	done := make(chan bool)
+	go func() {
+		source.Run()
+		close(done)
+	}()
+
+	select {
+	case id := <-acks:
+		assert.Equal(t, "env-1", id)
+	case <-time.After(5 * time.Second):
+		t.Error("the source didn't connect again")
+	}
+
+	<-session.sent
+
+	source.Stop()
+	<-done
+}
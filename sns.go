@@ -0,0 +1,163 @@
+package queue
+
+import (
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/pkg/errors"
+
+	// nolint: depguard
+	log "github.com/sirupsen/logrus"
+)
+
+// iSNSSession represents the interface to publish to a topic
+type iSNSSession interface {
+	Publish(input *sns.PublishInput) (*sns.PublishOutput, error)
+}
+
+// snsSender publishes to a topic the messages that the queue would send
+type snsSender struct {
+	SNS      iSNSSession
+	TopicARN string
+}
+
+func (s *snsSender) SendMessage(input *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
+	if aws.Int64Value(input.DelaySeconds) > 0 {
+		return nil, ErrorDelayNotSupported
+	}
+
+	if len(input.MessageAttributes) > maxMessageAttributes {
+		return nil, ErrorTooManyAttributes
+	}
+
+	messageAttributes := map[string]*sns.MessageAttributeValue{}
+	for name, attr := range input.MessageAttributes {
+		messageAttributes[name] = &sns.MessageAttributeValue{
+			DataType:    attr.DataType,
+			StringValue: attr.StringValue,
+			BinaryValue: attr.BinaryValue,
+		}
+	}
+
+	output, err := s.SNS.Publish(&sns.PublishInput{
+		TopicArn:          aws.String(s.TopicARN),
+		Message:           input.MessageBody,
+		MessageAttributes: messageAttributes,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "SNS.Publish error")
+	}
+
+	return &sqs.SendMessageOutput{
+		MessageId: output.MessageId,
+	}, nil
+}
+
+func (s *snsSender) ReceiveMessage(input *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	return nil, ErrorPublisherOnly
+}
+
+func (s *snsSender) DeleteMessage(input *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
+	return nil, ErrorPublisherOnly
+}
+
+// Publisher sends the messages to a SNS topic, so every queue subscribed to it
+// gets them. The messages are prepared as the queue does, and their attributes
+// go as SNS message attributes, the ones of the library packed into x-meta. SNS
+// takes up to 10 of them, a message with more fails with ErrorTooManyAttributes.
+// SNS has no delays
+type Publisher struct {
+	queue *queueSQS
+}
+
+// NewSNSPublisher returns a publisher to the topic. opts configure the messages
+// as they do for NewSQSQueue
+func NewSNSPublisher(snssession iSNSSession, topicARN string, opts ...Option) *Publisher {
+	queue := NewSQSQueue(&snsSender{SNS: snssession, TopicARN: topicARN}, topicARN, opts...)
+
+	return &Publisher{
+		queue: queue.(*queueSQS),
+	}
+}
+
+// PutString publishes an string
+func (p *Publisher) PutString(method, msg string, opts ...PutOption) *sqsResponseThenable {
+	return p.queue.PutString(method, msg, 0, opts...)
+}
+
+// PutJSON publishes a JSON
+func (p *Publisher) PutJSON(method string, msg interface{}, opts ...PutOption) *sqsResponseThenable {
+	return p.queue.PutJSON(method, msg, 0, opts...)
+}
+
+// Put publishes msg encoded with the codec of method, JSON by default
+func (p *Publisher) Put(method string, msg interface{}, opts ...PutOption) *sqsResponseThenable {
+	return p.queue.Put(method, msg, 0, opts...)
+}
+
+// snsEnvelope is the body of a message delivered by SNS without raw delivery
+type snsEnvelope struct {
+	Type              string
+	MessageID         string `json:"MessageId"`
+	TopicArn          string
+	Message           string
+	Timestamp         string
+	MessageAttributes map[string]struct {
+		Type  string
+		Value string
+	}
+}
+
+// unwrapSNS replaces the SNS envelope of m, if it has one, by the message it
+// carries and its attributes. With raw delivery there is no envelope
+func unwrapSNS(m *sqs.Message) {
+	if _, ok := m.MessageAttributes["Method"]; ok {
+		return
+	}
+
+	envelope := snsEnvelope{}
+	if err := json.Unmarshal([]byte(aws.StringValue(m.Body)), &envelope); err != nil {
+		return
+	}
+
+	if envelope.Type != "Notification" || envelope.TopicArn == "" {
+		return
+	}
+
+	messageAttributes := map[string]*sqs.MessageAttributeValue{}
+	for name, attr := range m.MessageAttributes {
+		messageAttributes[name] = attr
+	}
+
+	for name, attr := range envelope.MessageAttributes {
+		switch attr.Type {
+		case "Binary":
+			value, err := base64.StdEncoding.DecodeString(attr.Value)
+			if err != nil {
+				log.Errorf("Incorrect value of %s: %v", name, err)
+				continue
+			}
+
+			messageAttributes[name] = &sqs.MessageAttributeValue{
+				DataType:    aws.String("Binary"),
+				BinaryValue: value,
+			}
+		case "Number":
+			messageAttributes[name] = &sqs.MessageAttributeValue{
+				DataType:    aws.String("Number"),
+				StringValue: aws.String(attr.Value),
+			}
+		default:
+			messageAttributes[name] = &sqs.MessageAttributeValue{
+				DataType:    aws.String("String"),
+				StringValue: aws.String(attr.Value),
+			}
+		}
+	}
+
+	m.Body = aws.String(envelope.Message)
+	m.MessageAttributes = messageAttributes
+}
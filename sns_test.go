@@ -0,0 +1,187 @@
+package queue
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+)
+
+type Mock4SNSSession struct {
+	input *sns.PublishInput
+}
+
+func (a *Mock4SNSSession) Publish(input *sns.PublishInput) (*sns.PublishOutput, error) {
+	if err := checkAttributes(len(input.MessageAttributes)); err != nil {
+		return nil, err
+	}
+
+	a.input = input
+	return &sns.PublishOutput{
+		MessageId: aws.String("messageID"),
+	}, nil
+}
+
+// envelopeOf returns the message SNS delivers to a queue without raw delivery
+func envelopeOf(input *sns.PublishInput) *sqs.Message {
+	attributes := map[string]map[string]string{}
+	for name, attr := range input.MessageAttributes {
+		value := aws.StringValue(attr.StringValue)
+		if *attr.DataType == "Binary" {
+			value = base64.StdEncoding.EncodeToString(attr.BinaryValue)
+		}
+
+		attributes[name] = map[string]string{
+			"Type":  *attr.DataType,
+			"Value": value,
+		}
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"Type":              "Notification",
+		"MessageId":         "messageID",
+		"TopicArn":          *input.TopicArn,
+		"Message":           *input.Message,
+		"Timestamp":         "2021-03-01T10:30:00.000Z",
+		"MessageAttributes": attributes,
+	})
+
+	return &sqs.Message{
+		Body:              aws.String(string(body)),
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{},
+		MessageId:         aws.String("messageID"),
+		MD5OfBody:         aws.String("messageID"),
+	}
+}
+
+/*
+	Case 1: the publisher maps the attributes of the message to SNS
+*/
+func Test_Publisher_PutJSON(t *testing.T) {
+	session := &Mock4SNSSession{}
+	publisher := NewSNSPublisher(session, "arn:aws:sns:us-east-1:123456789012:requests")
+
+	assert.Nil(t, publisher.PutJSON("billing.charge", "a charge", IdempotencyKey("charge-1")).Error)
+	assert.Equal(t, "arn:aws:sns:us-east-1:123456789012:requests", *session.input.TopicArn)
+	assert.Equal(t, `{"msg":"a charge"}`, *session.input.Message)
+	assert.Equal(t, "billing.charge", *session.input.MessageAttributes["Method"].StringValue)
+	assert.Contains(t, *session.input.MessageAttributes[metaAttributeName].StringValue, `"IdempotencyKey":"charge-1"`)
+	assert.Equal(t, "Number", *session.input.MessageAttributes["NextDelayRetry"].DataType)
+}
+
+/*
+	Case 2: the listener unwraps the envelope before matching the handler
+*/
+func Test_dispatch_SNS_envelope(t *testing.T) {
+	session := &Mock4SNSSession{}
+	publisher := NewSNSPublisher(session, "arn:aws:sns:us-east-1:123456789012:requests", WithCompression(EncodingGzip))
+	assert.Nil(t, publisher.PutJSON("billing.charge", map[string]interface{}{"amount": float64(10)}).Error)
+
+	queue := NewSQSQueue(&MockAWSSessionThen{}, "requests").(*queueSQS)
+
+	handled := make(chan interface{}, 1)
+	queue.Register("billing.charge", func(msg interface{}) error {
+		handled <- msg
+		return nil
+	})
+
+	m := envelopeOf(session.input)
+	assert.Nil(t, queue.dispatch(m))
+	assert.Equal(t, map[string]interface{}{"amount": float64(10)}, <-handled)
+	assert.Equal(t, "billing.charge", *m.MessageAttributes["Method"].StringValue)
+	assert.Equal(t, EncodingGzip, *m.MessageAttributes["ContentEncoding"].StringValue)
+}
+
+/*
+	Case 3: with raw delivery, or without SNS, the message is left as it is
+*/
+func Test_unwrapSNS_raw(t *testing.T) {
+	raw := &sqs.Message{
+		Body: aws.String(`{"Type":"Notification","TopicArn":"arn","Message":"inner"}`),
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			"Method": {DataType: aws.String("String"), StringValue: aws.String("method")},
+		},
+	}
+	unwrapSNS(raw)
+	assert.Equal(t, `{"Type":"Notification","TopicArn":"arn","Message":"inner"}`, *raw.Body)
+
+	plain := &sqs.Message{
+		Body:              aws.String(`{"msg":"a message"}`),
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{},
+	}
+	unwrapSNS(plain)
+	assert.Equal(t, `{"msg":"a message"}`, *plain.Body)
+}
+
+/*
+	Case 4: SNS has no delays
+*/
+func Test_Publisher_delay_not_supported(t *testing.T) {
+	publisher := NewSNSPublisher(&Mock4SNSSession{}, "arn")
+
+	assert.Equal(t, ErrorDelayNotSupported, publisher.queue.PutJSON("method", "a message", 10).Error)
+}
+
+/*
+	Case 5: a message with more than 10 attributes isn't published
+*/
+func Test_Publisher_too_many_attributes(t *testing.T) {
+	session := &Mock4SNSSession{}
+	publisher := NewSNSPublisher(session, "arn")
+
+	attributes := func(messageAttributes map[string]*sqs.MessageAttributeValue) {
+		for i := 0; i < maxMessageAttributes; i++ {
+			messageAttributes[fmt.Sprintf("attribute-%d", i)] = &sqs.MessageAttributeValue{
+				DataType:    aws.String("String"),
+				StringValue: aws.String("a value"),
+			}
+		}
+	}
+
+	assert.Equal(t, ErrorTooManyAttributes, publisher.PutJSON("method", "a message", attributes).Error)
+	assert.Nil(t, session.input)
+
+	sender := &snsSender{SNS: session, TopicARN: "arn"}
+	_, err := sender.SendMessage(&sqs.SendMessageInput{
+		MessageBody:       aws.String("a message"),
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{},
+	})
+	assert.Nil(t, err)
+
+	input := &sqs.SendMessageInput{
+		MessageBody:       aws.String("a message"),
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{},
+	}
+	attributes(input.MessageAttributes)
+	withRequestID("id")(input.MessageAttributes)
+
+	_, err = sender.SendMessage(input)
+	assert.Equal(t, ErrorTooManyAttributes, err)
+}
+
+/*
+	Case 6: a bad Timestamp doesn't stop the unwrap
+*/
+func Test_unwrapSNS_bad_timestamp(t *testing.T) {
+	m := &sqs.Message{
+		Body: aws.String(`{
+			"Type": "Notification",
+			"TopicArn": "arn",
+			"Message": "a message",
+			"Timestamp": "not a time",
+			"MessageAttributes": {
+				"Method": {"Type": "String", "Value": "method"}
+			}
+		}`),
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{},
+	}
+
+	unwrapSNS(m)
+	assert.Equal(t, "a message", *m.Body)
+	assert.Equal(t, "method", *m.MessageAttributes["Method"].StringValue)
+}
@@ -1,6 +1,294 @@
 package queue
 
+import (
+	"encoding/json"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/pkg/errors"
+
+	// nolint: depguard
+	log "github.com/sirupsen/logrus"
+)
+
+// Then chains registered methods after the one the message is sent to. Once
+// the handler succeeds, the listener sends the message to the next method,
+// carrying the rest of the chain. The chain travels in the message, so it works
+// across instances and restarts
+func Then(methods ...string) PutOption {
+	return func(messageAttributes map[string]*sqs.MessageAttributeValue) {
+		if len(methods) == 0 {
+			return
+		}
+
+		chain, _ := json.Marshal(methods) // a list of strings always marshals
+		messageAttributes["Then"] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(string(chain)),
+		}
+	}
+}
+
+// Then calls callback with the message once its handler succeeds.
+//
+// Deprecated: the callback lives in the memory of this process, so it's lost on
+// a restart and never runs if another instance handles the message. Use the
+// Then PutOption to chain registered methods instead
 func (st *sqsResponseThenable) Then(callback MessageHandler) *sqsResponseThenable {
-	st.queue.thens[st.messageID] = append(st.queue.thens[st.messageID], callback)
+	q := st.queue
+	if q == nil || st.requestID == "" {
+		return st
+	}
+
+	q.thensMutex.Lock()
+	defer q.thensMutex.Unlock()
+
+	if q.thens == nil {
+		q.thens = map[string][]MessageHandler{}
+	}
+
+	q.thens[st.requestID] = append(q.thens[st.requestID], callback)
+
+	return st
+}
+
+// runThens calls the callbacks given to the deprecated Then for the request of m
+func (q *queueSQS) runThens(m *sqs.Message, msg interface{}) {
+	id := requestID(m)
+	if id == "" {
+		return
+	}
+
+	q.thensMutex.Lock()
+	callbacks := q.thens[id]
+	delete(q.thens, id)
+	q.thensMutex.Unlock()
+
+	for _, callback := range callbacks {
+		if err := callback(msg); err != nil {
+			log.Errorf("running then callback: %v", err)
+		}
+	}
+}
+
+// continueChain sends the result of the handler of m to the next method of the
+// chain, or the saga, of m. Without a result the body of m goes on as it came,
+// with its encoding. At the end of the chain the request is settled with the
+// result, or msg. It returns whether the body of m went on, so its offloaded
+// blob must be kept
+func (q *queueSQS) continueChain(m *sqs.Message, msg, result interface{}) (bool, error) {
+	if result != nil {
+		msg = result
+	}
+
+	saga, err := q.sagaOf(m)
+	if err != nil {
+		return false, err
+	}
+
+	if saga != nil {
+		return false, q.advanceSaga(m, saga, msg)
+	}
+
+	chain, err := thenChain(m)
+	if err != nil {
+		return false, err
+	}
+
+	if len(chain) == 0 {
+		q.settle(m, msg, nil)
+		return false, nil
+	}
+
+	if result == nil {
+		if err := q.forward(m, chain[0], Then(chain[1:]...), carry(m)); err != nil {
+			return false, errors.Wrapf(err, "sending to %s", chain[0])
+		}
+
+		return true, nil
+	}
+
+	thenable := q.Put(chain[0], msg, 0, Then(chain[1:]...), carry(m))
+	if thenable.Error != nil {
+		return false, errors.Wrapf(thenable.Error, "sending to %s", chain[0])
+	}
+
+	return false, nil
+}
+
+// bodyAttributes describe how the body of a message was encoded. The schema
+// version belongs to the method, so it's stamped again by forward
+var bodyAttributes = []string{
+	"ContentType", "ContentEncoding", "KeyID", "EncryptedDataKey", "BodyEncoding", "BlobKey",
+}
+
+// forward sends the body of m, as it came, to method
+func (q *queueSQS) forward(m *sqs.Message, method string, opts ...PutOption) error {
+	messageAttributes := map[string]*sqs.MessageAttributeValue{}
+	for _, name := range bodyAttributes {
+		if attr, ok := m.MessageAttributes[name]; ok && attr != nil {
+			messageAttributes[name] = attr
+		}
+	}
+
+	for _, opt := range opts {
+		opt(messageAttributes)
+	}
+
+	messageAttributes["NextDelayRetry"] = q.nextDelayRetry(0)
+	messageAttributes["Method"] = &sqs.MessageAttributeValue{
+		DataType:    aws.String("String"),
+		StringValue: aws.String(method),
+	}
+
+	q.stampSchemaVersion(method, messageAttributes)
+
+	_, err := q.send(aws.StringValue(m.Body), 0, messageAttributes)
+
+	return err
+}
+
+func thenChain(m *sqs.Message) ([]string, error) {
+	chainAttr, ok := m.MessageAttributes["Then"]
+	if !ok || chainAttr == nil {
+		return nil, nil
+	}
+
+	chain := []string{}
+	if err := json.Unmarshal([]byte(aws.StringValue(chainAttr.StringValue)), &chain); err != nil {
+		return nil, errors.Wrap(err, "Incorrect value of Then")
+	}
+
+	return chain, nil
+}
+
+// Catch calls callback with the error and the message once the request fails
+// for good: the message couldn't be sent, it reached maxNumberOfRetries or it
+// went to the dead-letter path. Only the listeners of this queue, and of its
+// Consumer, settle requests
+func (st *sqsResponseThenable) Catch(callback func(err error, msg interface{})) *sqsResponseThenable {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if st.settled {
+		if st.failure != nil {
+			callback(st.failure, st.msg)
+		}
+
+		return st
+	}
+
+	st.catches = append(st.catches, callback)
+	st.queue.track(st)
+
 	return st
 }
+
+// Finally calls callback once the request is done, either completed or failed.
+// A request sent with Then is completed at the end of the chain
+func (st *sqsResponseThenable) Finally(callback func()) *sqsResponseThenable {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if st.settled {
+		callback()
+		return st
+	}
+
+	st.finallies = append(st.finallies, callback)
+	st.queue.track(st)
+
+	return st
+}
+
+// settle fires the hooks, err is nil if the request completed
+func (st *sqsResponseThenable) settle(err error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if st.settled {
+		return
+	}
+
+	st.settled = true
+	st.failure = err
+
+	if err != nil {
+		for _, callback := range st.catches {
+			callback(err, st.msg)
+		}
+	}
+
+	for _, callback := range st.finallies {
+		callback()
+	}
+}
+
+// settle fires the hooks of the request of m, if it was put by this queue, and
+// sends the reply if the request expects one. err is nil if the request completed
+func (q *queueSQS) settle(m *sqs.Message, result interface{}, err error) {
+	q.groupDone(m, err == nil)
+
+	id := requestID(m)
+	if id == "" {
+		return
+	}
+
+	if err2 := q.reply(m, result, err); err2 != nil {
+		log.Errorf("sending reply: %v", err2)
+	}
+
+	q.pendingMutex.Lock()
+	thenable, ok := q.pending[id]
+	delete(q.pending, id)
+	q.pendingMutex.Unlock()
+
+	if ok {
+		thenable.settle(err)
+	}
+}
+
+// track keeps the thenable until its request is settled, only the ones with hooks are kept
+func (q *queueSQS) track(thenable *sqsResponseThenable) {
+	q.pendingMutex.Lock()
+	defer q.pendingMutex.Unlock()
+
+	if q.pending == nil {
+		q.pending = map[string]*sqsResponseThenable{}
+	}
+
+	q.pending[thenable.requestID] = thenable
+}
+
+// carry keeps the request of m, its reply and its group, in the next message of the chain
+func carry(m *sqs.Message) PutOption {
+	return func(messageAttributes map[string]*sqs.MessageAttributeValue) {
+		for _, name := range []string{"RequestID", "ReplyTo", "ReplyExpires", "Group"} {
+			if attr, ok := m.MessageAttributes[name]; ok && attr != nil {
+				messageAttributes[name] = attr
+			}
+		}
+	}
+}
+
+// withRequestID keeps the RequestID of a request along the messages of its chain
+func withRequestID(id string) PutOption {
+	return func(messageAttributes map[string]*sqs.MessageAttributeValue) {
+		if id == "" {
+			return
+		}
+
+		messageAttributes["RequestID"] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(id),
+		}
+	}
+}
+
+func requestID(m *sqs.Message) string {
+	if idAttr, ok := m.MessageAttributes["RequestID"]; ok && idAttr != nil {
+		return aws.StringValue(idAttr.StringValue)
+	}
+
+	return ""
+}
@@ -1,7 +1,9 @@
 package queue
 
 import (
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/sqs"
@@ -10,22 +12,44 @@ import (
 )
 
 type MockAWSSessionThen struct {
-	input *sqs.SendMessageInput
+	input            *sqs.SendMessageInput
+	delivered        bool
+	SendMessageError error
+	Locker           sync.Mutex
 }
 
 func (a *MockAWSSessionThen) SendMessage(input *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
+	if a.SendMessageError != nil {
+		return nil, a.SendMessageError
+	}
+
+	if err := checkAttributes(len(input.MessageAttributes)); err != nil {
+		return nil, err
+	}
+
+	a.Locker.Lock()
 	a.input = input
+	a.delivered = false
+	a.Locker.Unlock()
+
 	return &sqs.SendMessageOutput{
 		MessageId:        aws.String("messageID"),
 		MD5OfMessageBody: aws.String("messageID"),
 	}, nil
 }
 
+// ReceiveMessage delivers the last message sent, once
 func (a *MockAWSSessionThen) ReceiveMessage(input *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
-	if a.input == nil {
-		return nil, errors.New("nothing sent")
+	a.Locker.Lock()
+	defer a.Locker.Unlock()
+
+	if a.input == nil || a.delivered {
+		time.Sleep(10 * time.Millisecond)
+		return &sqs.ReceiveMessageOutput{}, nil
 	}
 
+	a.delivered = true
+
 	messageAttributes := map[string]*sqs.MessageAttributeValue{}
 
 	if value, ok := a.input.MessageAttributes["NextDelayRetry"]; ok && value != nil {
@@ -36,6 +60,10 @@ func (a *MockAWSSessionThen) ReceiveMessage(input *sqs.ReceiveMessageInput) (*sq
 		messageAttributes["Method"] = value
 	}
 
+	if value, ok := a.input.MessageAttributes[metaAttributeName]; ok && value != nil {
+		messageAttributes[metaAttributeName] = value
+	}
+
 	response := sqs.ReceiveMessageOutput{
 		Messages: []*sqs.Message{
 			{
@@ -54,18 +82,41 @@ func (a *MockAWSSessionThen) DeleteMessage(input *sqs.DeleteMessageInput) (*sqs.
 	return nil, nil
 }
 
+// listenUntil dispatches the messages of q until done is closed
+func listenUntil(q *queueSQS, done chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		messages, err := q.receive(0)
+		if err != nil {
+			continue
+		}
+
+		for _, msg := range messages {
+			_ = q.dispatch(msg)
+		}
+	}
+}
+
 func Test_Then_ok(t *testing.T) {
 	s := &MockAWSSessionThen{}
-	q := NewSQSQueue(s, "")
+	q := NewSQSQueue(s, "").(*queueSQS)
 
 	expectedMsg := "send this and take it from then"
 	q.Register("method", func(msg interface{}) error {
 		return nil
 	})
 
-	go q.Listen()
+	done := make(chan struct{})
+	defer close(done)
+
+	go listenUntil(q, done)
 
-	finish := make(chan bool)
+	finish := make(chan bool, 1)
 	actualMsg := ""
 	q.PutJSON("method", expectedMsg, 0).Then(func(msg interface{}) error {
 		actualMsg = msg.(string)
@@ -78,3 +129,182 @@ func Test_Then_ok(t *testing.T) {
 	assert.Equal(t, expectedMsg, actualMsg)
 
 }
+
+func Test_Then_chain_ok(t *testing.T) {
+	s := &MockAWSSessionThen{}
+	q := NewSQSQueue(s, "").(*queueSQS)
+
+	expectedMsg := "send this and take it from then"
+	q.Register("method", func(msg interface{}) error {
+		return nil
+	})
+
+	finish := make(chan string, 1)
+	q.Register("next", func(msg interface{}) error {
+		select {
+		case finish <- msg.(string):
+		default:
+		}
+
+		return nil
+	})
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go listenUntil(q, done)
+
+	assert.Nil(t, q.PutJSON("method", expectedMsg, 0, Then("next")).Error)
+
+	actualMsg := <-finish
+
+	assert.Equal(t, expectedMsg, actualMsg)
+}
+
+func Test_continueChain_sends_next_step(t *testing.T) {
+	s := &MockAWSSessionThen{}
+	q := NewSQSQueue(s, "").(*queueSQS)
+
+	assert.Nil(t, q.PutString("first", "a raw message", 0, Then("second", "third")).Error)
+	assert.Equal(t, `["second","third"]`, attributeOf(s.input, "Then"))
+
+	/*
+		Without a result, the body goes on as it came
+	*/
+
+	forwarded, err := q.continueChain(receivedMessage(s.input), "a raw message", nil)
+	assert.Nil(t, err)
+	assert.True(t, forwarded)
+	assert.Equal(t, "a raw message", *s.input.MessageBody)
+	assert.Equal(t, "second", *s.input.MessageAttributes["Method"].StringValue)
+	assert.Equal(t, `["third"]`, attributeOf(s.input, "Then"))
+
+	/*
+		The result of a handler is encoded for the next method
+	*/
+
+	forwarded, err = q.continueChain(receivedMessage(s.input), "a raw message", "a result")
+	assert.Nil(t, err)
+	assert.False(t, forwarded)
+	assert.Equal(t, `{"msg":"a result"}`, *s.input.MessageBody)
+	assert.Equal(t, "third", *s.input.MessageAttributes["Method"].StringValue)
+	assert.NotContains(t, attributesOf(s.input), "Then")
+
+	last := s.input
+	_, err = q.continueChain(receivedMessage(s.input), "a message", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, last, s.input)
+}
+
+func Test_continueChain_forward_schema_version(t *testing.T) {
+	s := &MockAWSSessionThen{}
+	q := NewSQSQueue(s, "", WithSchemaVersion("first", 2), WithSchemaVersion("third", 1)).(*queueSQS)
+
+	assert.Nil(t, q.PutJSON("first", "a message", 0, Then("second", "third")).Error)
+	assert.Equal(t, "2", attributeOf(s.input, "SchemaVersion"))
+
+	/*
+		The forwarded body takes the schema version of the next method
+	*/
+
+	_, err := q.continueChain(receivedMessage(s.input), "a message", nil)
+	assert.Nil(t, err)
+	assert.NotContains(t, attributesOf(s.input), "SchemaVersion")
+
+	second := receivedMessage(s.input)
+	msg, err := q.decode(second)
+	assert.Nil(t, err)
+	assert.Equal(t, "a message", msg)
+
+	_, err = q.continueChain(second, "a message", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "1", attributeOf(s.input, "SchemaVersion"))
+}
+
+func Test_continueChain_incorrect_Then(t *testing.T) {
+	q := NewSQSQueue(&MockAWSSessionThen{}, "").(*queueSQS)
+
+	msg := &sqs.Message{
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			"Then": {
+				DataType:    aws.String("String"),
+				StringValue: aws.String("not a list"),
+			},
+		},
+	}
+
+	_, err := q.continueChain(msg, "a message", nil)
+	assert.NotNil(t, err)
+}
+
+func Test_Catch_send_error(t *testing.T) {
+	s := &MockAWSSessionThen{
+		SendMessageError: errors.New("intentional error"),
+	}
+	q := NewSQSQueue(s, "")
+
+	caught := false
+	finished := false
+	q.PutJSON("method", "a message", 0).Catch(func(err error, msg interface{}) {
+		caught = true
+		assert.Equal(t, "intentional error", err.Error())
+		assert.Equal(t, "a message", msg)
+	}).Finally(func() {
+		finished = true
+	})
+
+	assert.True(t, caught)
+	assert.True(t, finished)
+}
+
+func Test_Catch_maxNumberOfRetries(t *testing.T) {
+	s := &MockAWSSessionThen{}
+	q := NewSQSQueue(s, "").(*queueSQS)
+	q.msgIDerrs["messageID"] = maxNumberOfRetries
+
+	caught := make(chan error, 1)
+	finished := make(chan bool, 1)
+	q.PutJSON("method", "a message", 0).Catch(func(err error, msg interface{}) {
+		assert.Equal(t, "a message", msg)
+		caught <- err
+	}).Finally(func() {
+		finished <- true
+	})
+
+	err := q.handleMessage(func(msg interface{}) error {
+		return nil
+	}, receivedMessage(s.input))
+
+	assert.Equal(t, ErrorRequestMaxRetries, err)
+	assert.Equal(t, ErrorRequestMaxRetries, <-caught)
+	assert.True(t, <-finished)
+}
+
+func Test_Finally_end_of_chain(t *testing.T) {
+	s := &Mock4EncryptAWSSession{
+		sent: make(chan *sqs.SendMessageInput, 1),
+	}
+	q := NewSQSQueue(s, "").(*queueSQS)
+
+	finished := make(chan bool, 1)
+	q.PutJSON("method", "a message", 0, Then("next")).Catch(func(err error, msg interface{}) {
+		t.Error(err)
+	}).Finally(func() {
+		finished <- true
+	})
+
+	handler := func(msg interface{}) error {
+		return nil
+	}
+
+	first := receivedMessage(<-s.sent)
+	assert.Nil(t, q.handleMessage(handler, first))
+
+	second := receivedMessage(<-s.sent)
+	assert.Equal(t, *first.MessageAttributes["RequestID"].StringValue, *second.MessageAttributes["RequestID"].StringValue)
+	assert.Empty(t, finished)
+
+	assert.Nil(t, q.handleMessage(handler, second))
+
+	assert.True(t, <-finished)
+}
@@ -1,6 +1,9 @@
 package queue
 
 import (
+	"sync"
+	"time"
+
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/pkg/errors"
 )
@@ -12,15 +15,49 @@ const (
 	retrySecondsToListen            = 5
 	timeoutSecondsDefault           = 5
 	nextDelayIncreaseSecondsDefault = 1
+	maxMessageSizeBytes             = 262144
+	replyVisibilityTimeoutSeconds   = 2
+	replyTTLSecondsDefault          = 300
 )
 
 // These are the error definitions
 var (
-	ErrorMethodAttrNil        = errors.New("methodAttr value is nil")
-	ErrorDeleteMessageTimeout = errors.New("timeout processing message from queue")
-	ErrorHandlerNotFound      = errors.New("handler not found in the register map")
-	ErrorMessageIDNotFound    = errors.New("response has no messageID value")
-	ErrorRequestMaxRetries    = errors.New("drop request from Queue as it failed maxNumberOfRetries times")
+	ErrorMethodAttrNil           = errors.New("methodAttr value is nil")
+	ErrorDeleteMessageTimeout    = errors.New("timeout processing message from queue")
+	ErrorHandlerNotFound         = errors.New("handler not found in the register map")
+	ErrorMessageIDNotFound       = errors.New("response has no messageID value")
+	ErrorRequestMaxRetries       = errors.New("drop request from Queue as it failed maxNumberOfRetries times")
+	ErrorBlobStoreNotSet         = errors.New("message body was offloaded but there is no blob store")
+	ErrorBlobKeyInvalid          = errors.New("invalid blob key")
+	ErrorEncodingUnknown         = errors.New("unknown content encoding")
+	ErrorKeyNotFound             = errors.New("master key not found")
+	ErrorCiphertextShort         = errors.New("ciphertext too short")
+	ErrorDecryptionFailed        = errors.New("message body decryption failed")
+	ErrorCodecNotFound           = errors.New("no codec for the content type of the message")
+	ErrorCodecUnsupportedType    = errors.New("the codec doesn't support the type of the message")
+	ErrorSchemaVersionUnknown    = errors.New("schema version of the message is newer than the current one")
+	ErrorUpcasterNotFound        = errors.New("upcaster not found")
+	ErrorReplyNotExpected        = errors.New("the request doesn't expect a reply, use ExpectReply and WithReplyQueue")
+	ErrorSagaNotFound            = errors.New("saga not found in the register map")
+	ErrorSagaStateInvalid        = errors.New("invalid saga state")
+	ErrorSagaCompensated         = errors.New("the saga failed and its steps were compensated")
+	ErrorSagaNotCompensated      = errors.New("the saga failed and some of its compensations failed too")
+	ErrorGroupStoreNotSet        = errors.New("there is no group store, use WithGroupStore")
+	ErrorIdempotencyKeyCompleted = errors.New("the operation of the idempotency key already completed")
+	ErrorIdempotencyKeyClaimed   = errors.New("the operation of the idempotency key is running")
+	ErrorTableNameInvalid        = errors.New("the table name must be an SQL identifier")
+	ErrorRateLimitInvalid        = errors.New("the rate and the burst of a limit must be positive")
+	ErrorGroupSealed             = errors.New("the group is closed, it takes no more members")
+	ErrorGroupTTLInvalid         = errors.New("the TTL of the groups must be positive, and of a second at least in Redis")
+	ErrorCronJobExists           = errors.New("a cron job with the same name already exists")
+	ErrorRouteNotFound           = errors.New("no route matches the method")
+	ErrorDefaultRouteConflict    = errors.New("the default route is the route *, set only one of them")
+	ErrorDelayNotSupported       = errors.New("SNS doesn't support delays")
+	ErrorPublisherOnly           = errors.New("a SNS publisher can't receive messages")
+	ErrorTooManyAttributes       = errors.New("a message takes up to 10 attributes")
+	ErrorWebhookSecretNotSet     = errors.New("a webhook route without a secret must be insecure")
+	ErrorQueueNotSupported       = errors.New("the queue must be one returned by NewSQSQueue")
+	ErrorFIFODelayNotSupported   = errors.New("FIFO queues don't support delays per message")
 )
 
 // iSQSSession represents the interface to connect to a Queue
@@ -30,15 +67,78 @@ type iSQSSession interface {
 	DeleteMessage(input *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error)
 }
 
+// iSQSQueueAdmin creates and deletes the temporary reply queues
+type iSQSQueueAdmin interface {
+	CreateQueue(input *sqs.CreateQueueInput) (*sqs.CreateQueueOutput, error)
+	DeleteQueue(input *sqs.DeleteQueueInput) (*sqs.DeleteQueueOutput, error)
+}
+
 // queueSQS - A queue backed by SQS.
 type queueSQS struct {
-	SQS                      iSQSSession
-	URL                      string
+	queueConfig
+	*requests
+	SQS               iSQSSession
+	URL               string
+	listenRepliesOnce sync.Once
+	replyAdmin        iSQSQueueAdmin
+	replyQueuePrefix  string
+	repliesDone       chan struct{}
+	workers           chan struct{}
+	msgIDerrs         map[string]int
+	msgIDerrsMutex    sync.Mutex
+}
+
+// queueConfig is the configuration and the registry of a queue, shared with the
+// queues of its Consumer
+type queueConfig struct {
 	TimeoutSeconds           int
 	NextDelayIncreaseSeconds int64
+	Blobs                    BlobStore
+	OffloadThresholdBytes    int
+	Compression              string
+	Keys                     KeyProvider
+	KeyID                    string
+	DeadLetterURL            string
+	Codec                    Codec
+	ReplyURL                 string
+	ReplyTTL                 time.Duration
+	Groups                   GroupStore
+	Dedup                    DedupStore
+	methodCodecs             map[string]Codec
+	schemaVersions           map[string]int
+	upcasters                map[string]map[int]Upcaster
+	replyHandlerMap          map[string]ReplyHandler
+	sagaMap                  map[string][]SagaStep
 	handlerMap               map[string]MessageHandler
-	msgIDerrs                map[string]int
-	thens                    map[string][]MessageHandler
+	handlerConfigs           map[string]*handlerConfig
+	replyHandlerConfigs      map[string]*handlerConfig
+	handlers                 *methodMatcher
+}
+
+// requests keeps the requests sent by a queue until they are settled. The
+// queues of its Consumer settle them too, so they share it
+type requests struct {
+	pending      map[string]*sqsResponseThenable
+	pendingMutex sync.Mutex
+	replies      map[string]chan replyMessage
+	repliesMutex sync.Mutex
+	thens        map[string][]MessageHandler
+	thensMutex   sync.Mutex
+}
+
+// Option configures the queue returned by NewSQSQueue
+type Option func(q *queueSQS)
+
+// PutOption sets the attributes of a single message sent by Put, PutJSON or PutString
+type PutOption func(messageAttributes map[string]*sqs.MessageAttributeValue)
+
+// HandlerOption configures how the listener dispatches to a registered method
+type HandlerOption func(config *handlerConfig)
+
+type handlerConfig struct {
+	rateLimiter RateLimiter
+	breaker     *circuitBreaker
+	inFlight    chan struct{}
 }
 
 // MessageHandler receives from the queue the message. Use Register to define the handler
@@ -50,14 +150,36 @@ type msgJSON struct {
 
 // SQSQueue defines the special SQS-Queue that accepts handlers via Register
 type SQSQueue interface {
-	PutString(method, msg string, delaySeconds int64) *sqsResponseThenable
-	PutJSON(method string, msg interface{}, delaySeconds int64) *sqsResponseThenable
-	Register(name string, method MessageHandler)
+	PutString(method, msg string, delaySeconds int64, opts ...PutOption) *sqsResponseThenable
+	PutJSON(method string, msg interface{}, delaySeconds int64, opts ...PutOption) *sqsResponseThenable
+	Put(method string, msg interface{}, delaySeconds int64, opts ...PutOption) *sqsResponseThenable
+	PutAt(method string, msg interface{}, at time.Time, opts ...PutOption) *sqsResponseThenable
+	PutAfter(method string, msg interface{}, after time.Duration, opts ...PutOption) *sqsResponseThenable
+	Register(name string, method MessageHandler, opts ...HandlerOption)
+	RegisterReply(name string, method ReplyHandler, opts ...HandlerOption)
+	RegisterSaga(name string, steps ...SagaStep)
+	PutSaga(name string, msg interface{}, delaySeconds int64, opts ...PutOption) *sqsResponseThenable
+	NewGroup(onComplete string) *Group
+	Circuit(method string) (CircuitStats, bool)
+	Circuits() []CircuitStats
+	InFlight(method string) (int, bool)
+	RoutingTable() []HandlerRoute
+	Resolve(method string) (string, bool)
 	Listen()
+	Close() error
 }
 
 type sqsResponseThenable struct {
 	queue     *queueSQS
 	messageID string
+	requestID string
+	msg       interface{}
+	mutex     sync.Mutex
+	settled   bool
+	failure   error
+	catches   []func(err error, msg interface{})
+	finallies []func()
+	reply     chan replyMessage
+	received  *replyMessage
 	Error     error
 }
@@ -0,0 +1,127 @@
+package queue
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	// nolint: depguard
+	log "github.com/sirupsen/logrus"
+)
+
+const webhookSignatureHeaderDefault = "X-Signature-256"
+
+// WebhookRoute sends the webhooks posted to Path to the registered Method. The
+// SignatureHeader must carry the HMAC-SHA256 of the body with Secret, in hex and
+// optionally prefixed by sha256=. A route without a Secret must be Insecure. The
+// DeliveryIDHeader, if any, carries the id of the delivery, so a webhook
+// delivered again is handled once
+type WebhookRoute struct {
+	Path             string `json:"path"`
+	Method           string `json:"method"`
+	Secret           string `json:"secret,omitempty"`
+	SignatureHeader  string `json:"signature_header,omitempty"`
+	Insecure         bool   `json:"insecure,omitempty"`
+	DeliveryIDHeader string `json:"delivery_id_header,omitempty"`
+}
+
+// WebhookServer is a http.Handler that puts the JSON of the webhooks into the
+// queue, and answers as soon as they are enqueued
+type WebhookServer struct {
+	queue        SQSQueue
+	routes       map[string]WebhookRoute
+	MaxBodyBytes int64
+}
+
+// NewWebhookServer returns a server of routes that puts into queue
+func NewWebhookServer(queue SQSQueue, routes ...WebhookRoute) (*WebhookServer, error) {
+	s := &WebhookServer{
+		queue:        queue,
+		routes:       map[string]WebhookRoute{},
+		MaxBodyBytes: maxMessageSizeBytes,
+	}
+
+	for _, route := range routes {
+		if route.Secret == "" && !route.Insecure {
+			return nil, errors.Wrap(ErrorWebhookSecretNotSet, route.Path)
+		}
+
+		if route.SignatureHeader == "" {
+			route.SignatureHeader = webhookSignatureHeaderDefault
+		}
+
+		s.routes[route.Path] = route
+	}
+
+	return s, nil
+}
+
+func (s *WebhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route, ok := s.routes[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, s.MaxBodyBytes+1))
+	if err != nil {
+		http.Error(w, "reading body", http.StatusBadRequest)
+		return
+	}
+
+	if int64(len(body)) > s.MaxBodyBytes {
+		http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if route.Secret != "" && !validSignature(body, route.Secret, r.Header.Get(route.SignatureHeader)) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	if !json.Valid(body) {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	opts := []PutOption{}
+	if id := r.Header.Get(route.DeliveryIDHeader); route.DeliveryIDHeader != "" && id != "" {
+		opts = append(opts, IdempotencyKey(route.Method+":"+id))
+	}
+
+	if thenable := s.queue.PutJSON(route.Method, json.RawMessage(body), 0, opts...); thenable.Error != nil {
+		log.Errorf("enqueuing webhook %s: %v", route.Path, thenable.Error)
+		http.Error(w, "try again later", http.StatusServiceUnavailable)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// validSignature tells if signature is the HMAC-SHA256 of body with secret
+func validSignature(body []byte, secret, signature string) bool {
+	expected, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil || len(expected) == 0 {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+
+	return hmac.Equal(mac.Sum(nil), expected)
+}
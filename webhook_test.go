@@ -0,0 +1,123 @@
+package queue
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func sign(body, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte(body))
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func postWebhook(server http.Handler, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	return w
+}
+
+/*
+	Case 1: a signed webhook is enqueued to the method of its path
+*/
+func Test_WebhookServer_enqueues(t *testing.T) {
+	session := &MockAWSSessionThen{}
+	server, err := NewWebhookServer(NewSQSQueue(session, "requests"),
+		WebhookRoute{Path: "/webhooks/payments", Method: "payments.event", Secret: "s3cr3t"},
+		WebhookRoute{Path: "/webhooks/github", Method: "github.event", Secret: "s3cr3t", SignatureHeader: "X-Hub-Signature-256", DeliveryIDHeader: "X-GitHub-Delivery"},
+	)
+	assert.Nil(t, err)
+
+	body := `{"type":"charge.succeeded"}`
+	w := postWebhook(server, "/webhooks/payments", body, map[string]string{"X-Signature-256": sign(body, "s3cr3t")})
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Equal(t, "payments.event", *session.input.MessageAttributes["Method"].StringValue)
+	assert.Equal(t, `{"msg":{"type":"charge.succeeded"}}`, *session.input.MessageBody)
+	assert.NotContains(t, attributesOf(session.input), "IdempotencyKey")
+
+	w = postWebhook(server, "/webhooks/github", body, map[string]string{
+		"X-Hub-Signature-256": sign(body, "s3cr3t"),
+		"X-GitHub-Delivery":   "delivery-1",
+	})
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Equal(t, "github.event", *session.input.MessageAttributes["Method"].StringValue)
+	assert.Equal(t, "github.event:delivery-1", attributeOf(session.input, "IdempotencyKey"))
+
+	/*
+		The body goes on as it came
+	*/
+	body = `{"amount": 10.10, "big": 12345678901234567890}`
+	w = postWebhook(server, "/webhooks/payments", body, map[string]string{"X-Signature-256": sign(body, "s3cr3t")})
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Equal(t, `{"msg":{"amount":10.10,"big":12345678901234567890}}`, *session.input.MessageBody)
+}
+
+/*
+	Case 2: the webhooks that can't be verified or read are rejected
+*/
+func Test_WebhookServer_rejects(t *testing.T) {
+	session := &MockAWSSessionThen{}
+	server, err := NewWebhookServer(NewSQSQueue(session, "requests"),
+		WebhookRoute{Path: "/webhooks/payments", Method: "payments.event", Secret: "s3cr3t"},
+		WebhookRoute{Path: "/webhooks/open", Method: "open.event", Insecure: true},
+	)
+	assert.Nil(t, err)
+	server.MaxBodyBytes = 64
+
+	body := `{"type":"charge.succeeded"}`
+
+	w := postWebhook(server, "/webhooks/payments", body, map[string]string{"X-Signature-256": sign(body, "other")})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = postWebhook(server, "/webhooks/payments", body, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = postWebhook(server, "/webhooks/unknown", body, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = postWebhook(server, "/webhooks/open", "not json", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = postWebhook(server, "/webhooks/open", `{"data":"`+strings.Repeat("x", 64)+`"}`, nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	r := httptest.NewRequest(http.MethodGet, "/webhooks/open", nil)
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	assert.Nil(t, session.input)
+
+	/*
+		If the webhook can't be enqueued the sender should try again
+	*/
+	session.SendMessageError = errors.New("intentional error")
+
+	w = postWebhook(server, "/webhooks/open", body, nil)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+/*
+	Case 3: a route without a secret must be explicitly insecure
+*/
+func Test_NewWebhookServer_secret_not_set(t *testing.T) {
+	_, err := NewWebhookServer(NewSQSQueue(&MockAWSSessionThen{}, "requests"),
+		WebhookRoute{Path: "/webhooks/open", Method: "open.event"},
+	)
+	assert.Equal(t, ErrorWebhookSecretNotSet, errors.Cause(err))
+}